@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var configFile = flag.String("config", "", "JSON file listing the thermostat accounts to poll; replaces -thermostat-provider and the provider flags")
+
+// Config is the format of -config.
+type Config struct {
+	Accounts []AccountConfig `json:"accounts"`
+}
+
+// AccountConfig holds the credentials and devices of one thermostat
+// account. Fields that don't apply to Provider are ignored.
+type AccountConfig struct {
+	Name               string   `json:"name"`
+	Provider           string   `json:"provider"`
+	ClientSecret       string   `json:"client_secret"`
+	ThermostatIDs      []string `json:"thermostat_ids"`
+	Discover           bool     `json:"discover_thermostats"`
+	EcobeeAPIKey       string   `json:"ecobee_apikey"`
+	EcobeeRefreshToken string   `json:"ecobee_refresh_token"`
+	EcobeeTokenFile    string   `json:"ecobee_token_file"`
+}
+
+// defaultAccount names the account configured through flags.
+const defaultAccount = "default"
+
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// loadAccountConfigs reads -config, or builds a single account from the
+// command line flags if there is no config file.
+func loadAccountConfigs() ([]AccountConfig, error) {
+	if *configFile == "" {
+		cfg := AccountConfig{
+			Name:               defaultAccount,
+			Provider:           *thermostatProviderName,
+			ClientSecret:       *clientSecret,
+			ThermostatIDs:      splitList(*thermostatID),
+			Discover:           *discoverThermostats,
+			EcobeeAPIKey:       *ecobeeAPIKey,
+			EcobeeRefreshToken: *ecobeeRefreshToken,
+			EcobeeTokenFile:    *ecobeeTokenFile,
+		}
+		if cfg.Provider == "ecobee" {
+			cfg.ThermostatIDs = splitList(*ecobeeThermostatIDs)
+		}
+		return []AccountConfig{cfg}, nil
+	}
+
+	b, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", *configFile, err)
+	}
+	if len(config.Accounts) == 0 {
+		return nil, fmt.Errorf("%s: no accounts configured", *configFile)
+	}
+	seen := map[string]bool{}
+	for i := range config.Accounts {
+		cfg := &config.Accounts[i]
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("%s: account %d has no name", *configFile, i+1)
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("%s: duplicate account name %q", *configFile, cfg.Name)
+		}
+		seen[cfg.Name] = true
+		if cfg.Provider == "" {
+			cfg.Provider = "nest"
+		}
+	}
+	return config.Accounts, nil
+}
+
+// account is a configured set of credentials, polled independently of the
+// others.
+type account struct {
+	name         string
+	providerName string
+	provider     ThermostatProvider
+	pollNow      chan struct{} // asks the account's poller for an extra poll
+}
+
+// requestPoll asks the poller of a to poll again without waiting for the
+// next tick. Requests made while one is already pending are merged.
+func (a *account) requestPoll() {
+	select {
+	case a.pollNow <- struct{}{}:
+	default:
+	}
+}
+
+var accounts []*account
+
+func setupAccounts() error {
+	configs, err := loadAccountConfigs()
+	if err != nil {
+		return err
+	}
+	for _, cfg := range configs {
+		provider, err := newThermostatProvider(cfg)
+		if err != nil {
+			return fmt.Errorf("account %s: %v", cfg.Name, err)
+		}
+		accounts = append(accounts, &account{name: cfg.Name, providerName: cfg.Provider, provider: provider, pollNow: make(chan struct{}, 1)})
+	}
+	return nil
+}
+
+// findAccount returns the named account; an empty name is fine if there
+// is only one.
+func findAccount(name string) (*account, error) {
+	if name == "" {
+		if len(accounts) == 1 {
+			return accounts[0], nil
+		}
+		return nil, errors.New("account required")
+	}
+	for _, a := range accounts {
+		if a.name == name {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown account %q", name)
+}
+
+// AccountData is the last fetched state of one account.
+type AccountData struct {
+	Provider    string    `json:"provider"`
+	Stamp       time.Time `json:"thermostatStamp"`
+	Thermostats []Reading `json:"thermostats"`
+	Up          bool      `json:"up"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// accountData is guarded by currentDataMutex.
+var accountData = map[string]*AccountData{}
+
+var (
+	promThermostatUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thermostat_up",
+		Help: "Flag (0 or 1) indicating if the last poll of the account succeeded.",
+	}, []string{"account"})
+	promThermostatLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thermostat_last_success_timestamp_seconds",
+		Help: "Time of the last successful poll of the account, as a Unix timestamp.",
+	}, []string{"account"})
+)
+
+func init() {
+	collectGroup("thermostat.status", promThermostatUp, promThermostatLastSuccess)
+}
+
+func findReading(readings []Reading, deviceID string) (Reading, bool) {
+	for _, ts := range readings {
+		if ts.DeviceID == deviceID {
+			return ts, true
+		}
+	}
+	return Reading{}, false
+}
+
+// collectAccount polls all thermostats of a and stores the results.
+func collectAccount(ctx context.Context, a *account) error {
+	readings, err := a.provider.Fetch(ctx)
+	if err == nil && len(readings) == 0 {
+		err = errors.New("thermostat provider returned no readings")
+	}
+	if err != nil {
+		log.Printf("error: account %s: %v", a.name, err)
+		currentDataMutex.Lock()
+		data := accountDataFor(a)
+		data.Up = false
+		data.LastError = err.Error()
+		currentDataMutex.Unlock()
+		promThermostatUp.WithLabelValues(a.name).Set(0)
+		return err
+	}
+
+	now := time.Now()
+	currentDataMutex.Lock()
+	data := accountDataFor(a)
+	var updated, fresh []Reading
+	seen := map[string]bool{}
+	for _, ts := range readings {
+		ts.Account = a.name
+		if *doDebug {
+			log.Printf("%v", ts)
+		}
+		previous, known := findReading(data.Thermostats, ts.DeviceID)
+		empty := emptyThermostatData(ts)
+		valid := false
+		if empty {
+			ts = rejectEmptyThermostatData(ts, previous)
+		} else {
+			ts, valid = validateThermostatData(calibrateReading(ts), previous)
+		}
+		// Without a previous reading there is nothing to fall back to, so
+		// leave the thermostat out until it sends a complete one.
+		if !known && !valid {
+			log.Printf("warning: account %s: ignoring thermostat %s until it sends a valid reading", a.name, ts.DeviceID)
+			continue
+		}
+		if !empty {
+			fresh = append(fresh, ts)
+		}
+		if !known && !data.Stamp.IsZero() {
+			log.Printf("account %s: thermostat %s appeared", a.name, ts.DeviceID)
+		}
+		seen[ts.DeviceID] = true
+		updated = append(updated, ts)
+	}
+	var removed []Reading
+	for _, ts := range data.Thermostats {
+		if !seen[ts.DeviceID] {
+			log.Printf("account %s: thermostat %s disappeared", a.name, ts.DeviceID)
+			removed = append(removed, ts)
+		}
+	}
+	data.Thermostats = updated
+	data.Up = true
+	data.LastError = ""
+	// If every reading was rejected, nothing is fresh: keep the old stamp
+	// so the data goes stale, and log no samples.
+	if len(fresh) > 0 {
+		data.Stamp = now
+	} else {
+		data.LastError = "all readings rejected"
+	}
+	currentDataMutex.Unlock()
+
+	promThermostatUp.WithLabelValues(a.name).Set(1)
+	if len(fresh) > 0 {
+		promThermostatLastSuccess.WithLabelValues(a.name).Set(float64(now.Unix()))
+	}
+	for _, ts := range removed {
+		deleteThermostatGauges(ts)
+	}
+	for _, ts := range updated {
+		setThermostatGauges(ts)
+	}
+	for _, ts := range fresh {
+		recordSample(thermostatSample(ts, now))
+	}
+	saveState()
+	return nil
+}
+
+// accountDataFor returns the stored data of a, creating it if needed. Must
+// be called with currentDataMutex held.
+func accountDataFor(a *account) *AccountData {
+	data, ok := accountData[a.name]
+	if !ok {
+		data = &AccountData{Provider: a.providerName}
+		accountData[a.name] = data
+	}
+	return data
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var alertTempMin = flag.Float64("alert-temp-min", 0, "alert when an indoor temperature (°C) falls below this")
+var alertTempMax = flag.Float64("alert-temp-max", 0, "alert when an indoor temperature (°C) rises above this")
+var alertStale = flag.Duration("alert-stale", 0, "alert when a source has had no fresh data for this long (0 disables)")
+var alertCooldown = flag.Duration("alert-cooldown", 30*time.Minute, "minimum time between two notifications about the same condition")
+var alertWebhookURL = flag.String("alert-webhook-url", "", "URL to POST alert notifications to as JSON")
+var alertCommand = flag.String("alert-command", "", "command to run for alert notifications, with the JSON payload on stdin")
+
+var (
+	promActiveAlerts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "active_alerts",
+		Help: "Flag (0 or 1) indicating if an alert condition is active.",
+	}, []string{"condition", "subject"})
+	promAlertNotificationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "alert_notification_errors_total",
+		Help: "Alert notifications that could not be delivered.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(promActiveAlerts)
+	prometheus.MustRegister(promAlertNotificationErrors)
+}
+
+// alertTempMinSet and alertTempMaxSet are whether the range flags were
+// given, since 0 °C is a valid threshold.
+var alertTempMinSet, alertTempMaxSet bool
+
+// setupAlerts looks at which alert flags were given. Call it after
+// flag.Parse.
+func setupAlerts() {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "alert-temp-min":
+			alertTempMinSet = true
+		case "alert-temp-max":
+			alertTempMaxSet = true
+		}
+	})
+}
+
+// Alert is one condition found by evaluateAlerts, and the payload of
+// notifications.
+type Alert struct {
+	Condition string    `json:"condition"`
+	Subject   string    `json:"subject"`
+	State     string    `json:"state"` // "firing" or "resolved"
+	Since     time.Time `json:"since"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Timestamp time.Time `json:"timestamp"` // of the data the value is from
+	Message   string    `json:"message"`
+}
+
+func (a Alert) key() string {
+	return a.Condition + "\x00" + a.Subject
+}
+
+// alertState is what we know about one condition. notified is the state
+// last sent out; it lags behind active while the cooldown lasts. States
+// are kept after clearing so the cooldown also applies to a condition
+// that comes back.
+type alertState struct {
+	alert        Alert
+	active       bool
+	notified     bool
+	lastNotified time.Time
+}
+
+var (
+	alertStates = map[string]*alertState{}
+	alertMutex  sync.Mutex
+	alertStart  = time.Now()
+)
+
+// findAlerts returns the conditions that hold in snap at now.
+func findAlerts(snap StampedData, now time.Time) []Alert {
+	var alerts []Alert
+	for _, name := range sortedAccountNames(snap.Accounts) {
+		data := snap.Accounts[name]
+		for _, ts := range data.Thermostats {
+			subject := name + "/" + ts.DeviceID
+			if alertTempMinSet && ts.CurrentTemperature < *alertTempMin {
+				alerts = append(alerts, Alert{
+					Condition: "temperature_low", Subject: subject,
+					Value: ts.CurrentTemperature, Threshold: *alertTempMin, Timestamp: data.Stamp,
+					Message: fmt.Sprintf("%s: temperature %.1f °C is below %.1f °C", subject, ts.CurrentTemperature, *alertTempMin),
+				})
+			}
+			if alertTempMaxSet && ts.CurrentTemperature > *alertTempMax {
+				alerts = append(alerts, Alert{
+					Condition: "temperature_high", Subject: subject,
+					Value: ts.CurrentTemperature, Threshold: *alertTempMax, Timestamp: data.Stamp,
+					Message: fmt.Sprintf("%s: temperature %.1f °C is above %.1f °C", subject, ts.CurrentTemperature, *alertTempMax),
+				})
+			}
+		}
+	}
+	if *alertStale > 0 {
+		pollTrackersMutex.Lock()
+		trackers := append([]*pollTracker(nil), pollTrackers...)
+		pollTrackersMutex.Unlock()
+		for _, t := range trackers {
+			var stamp time.Time
+			if t.source == sourceWeather {
+				stamp = snap.WeatherStamp
+			} else if data, ok := snap.Accounts[t.account]; ok {
+				stamp = data.Stamp
+			}
+			// A source that never delivered counts from startup.
+			since := stamp
+			if since.IsZero() {
+				since = alertStart
+			}
+			if age := now.Sub(since); age > *alertStale {
+				alerts = append(alerts, Alert{
+					Condition: "stale", Subject: t.String(),
+					Value: age.Seconds(), Threshold: alertStale.Seconds(), Timestamp: stamp,
+					Message: fmt.Sprintf("%s: no fresh data for %v", t, age.Round(time.Second)),
+				})
+			}
+		}
+	}
+	return alerts
+}
+
+func sortedAccountNames(m map[string]*AccountData) []string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// evaluateAlerts checks the current snapshot, updates active_alerts and
+// sends notifications for conditions that started or cleared, at most
+// once per -alert-cooldown for each condition.
+func evaluateAlerts(now time.Time) {
+	if !alertTempMinSet && !alertTempMaxSet && *alertStale <= 0 {
+		return
+	}
+	found := map[string]Alert{}
+	for _, a := range findAlerts(currentSnapshot(), now) {
+		found[a.key()] = a
+	}
+
+	alertMutex.Lock()
+	defer alertMutex.Unlock()
+	for key, a := range found {
+		s, ok := alertStates[key]
+		if !ok {
+			s = &alertState{}
+			alertStates[key] = s
+		}
+		if !s.active {
+			s.active = true
+			a.Since = now
+			log.Printf("alert: %s", a.Message)
+		} else {
+			a.Since = s.alert.Since
+		}
+		s.alert = a
+		promActiveAlerts.WithLabelValues(a.Condition, a.Subject).Set(1)
+	}
+	for key, s := range alertStates {
+		if _, ok := found[key]; ok || !s.active {
+			continue
+		}
+		s.active = false
+		s.alert.Since = now
+		s.alert.Message = s.alert.Subject + ": " + s.alert.Condition + " cleared"
+		log.Printf("alert: %s", s.alert.Message)
+		promActiveAlerts.DeleteLabelValues(s.alert.Condition, s.alert.Subject)
+	}
+	for _, s := range alertStates {
+		if s.active == s.notified || now.Sub(s.lastNotified) < *alertCooldown {
+			continue
+		}
+		s.notified = s.active
+		s.lastNotified = now
+		a := s.alert
+		a.State = "resolved"
+		if s.active {
+			a.State = "firing"
+		}
+		go notifyAlert(a)
+	}
+}
+
+// safeEvaluateAlerts runs evaluateAlerts, recovering from a panic like a
+// failed poll so it cannot take down the poll goroutine or the watchdog.
+func safeEvaluateAlerts(now time.Time) {
+	recoverPoll("alerts", "alerts", func() error {
+		evaluateAlerts(now)
+		return nil
+	})
+}
+
+// notifyAlert sends a to the webhook and/or the command.
+func notifyAlert(a Alert) {
+	if *alertWebhookURL == "" && *alertCommand == "" {
+		return
+	}
+	b, _ := json.Marshal(a)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if *alertWebhookURL != "" {
+		if err := postAlert(ctx, b); err != nil {
+			log.Printf("error: alert webhook: %v", err)
+			promAlertNotificationErrors.Inc()
+		}
+	}
+	if *alertCommand != "" {
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", *alertCommand)
+		cmd.Stdin = bytes.NewReader(b)
+		cmd.Env = append(os.Environ(),
+			"ALERT_CONDITION="+a.Condition,
+			"ALERT_SUBJECT="+a.Subject,
+			"ALERT_STATE="+a.State,
+			"ALERT_MESSAGE="+a.Message)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("error: alert command: %v: %s", err, strings.TrimSpace(string(out)))
+			promAlertNotificationErrors.Inc()
+		}
+	}
+}
+
+func postAlert(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", *alertWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
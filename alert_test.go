@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func resetAlerts(t *testing.T) {
+	savedStale, savedCooldown, savedMin := *alertStale, *alertCooldown, *alertTempMin
+	savedMinSet, savedMaxSet := alertTempMinSet, alertTempMaxSet
+	t.Cleanup(func() {
+		*alertStale, *alertCooldown, *alertTempMin = savedStale, savedCooldown, savedMin
+		alertTempMinSet, alertTempMaxSet = savedMinSet, savedMaxSet
+		alertMutex.Lock()
+		alertStates = map[string]*alertState{}
+		alertMutex.Unlock()
+	})
+	alertTempMinSet, alertTempMaxSet = false, false
+	*alertStale = 0
+}
+
+func TestStaleAlertWithHangingPoll(t *testing.T) {
+	resetAlerts(t)
+	*alertStale = time.Hour
+
+	// The only poll of this source never finishes, so only the watchdog's
+	// evaluation can notice.
+	tracker := newPollTracker(sourceThermostat, "hanging-account")
+	tracker.begin(time.Now())
+
+	safeEvaluateAlerts(time.Now())
+	if got := testutil.ToFloat64(promActiveAlerts.WithLabelValues("stale", "thermostat/hanging-account")); got != 0 {
+		t.Errorf("stale alert active right after startup")
+	}
+	safeEvaluateAlerts(time.Now().Add(2 * time.Hour))
+	if got := testutil.ToFloat64(promActiveAlerts.WithLabelValues("stale", "thermostat/hanging-account")); got != 1 {
+		t.Errorf("active_alerts{stale} = %v, want 1", got)
+	}
+}
+
+func TestTemperatureAlertCooldown(t *testing.T) {
+	resetAlerts(t)
+	*alertTempMin, alertTempMinSet = 12, true
+	*alertCooldown = 30 * time.Minute
+
+	p := &fakeProvider{readings: []Reading{{Provider: "fake", DeviceID: "t1", CurrentTemperature: 10, CurrentHumidity: 40, TargetTemperature: 18}}}
+	a := &account{name: "alert-account", providerName: "fake", provider: p}
+	key := Alert{Condition: "temperature_low", Subject: "alert-account/t1"}.key()
+	state := func() alertState {
+		alertMutex.Lock()
+		defer alertMutex.Unlock()
+		return *alertStates[key]
+	}
+	start := time.Now()
+
+	collectAccount(context.Background(), a)
+	evaluateAlerts(start)
+	if s := state(); !s.active || !s.notified || s.alert.Value != 10 || s.alert.Threshold != 12 {
+		t.Fatalf("after dropping below the minimum: %+v", s)
+	}
+
+	// Clearing within the cooldown is not notified yet.
+	p.readings[0].CurrentTemperature = 15
+	collectAccount(context.Background(), a)
+	evaluateAlerts(start.Add(10 * time.Minute))
+	if s := state(); s.active || !s.notified {
+		t.Errorf("cleared within the cooldown: %+v", s)
+	}
+	if promActiveAlerts.DeleteLabelValues("temperature_low", "alert-account/t1") {
+		t.Error("active_alerts still set after clearing")
+	}
+
+	// Once the cooldown has passed, the clearing is sent.
+	evaluateAlerts(start.Add(31 * time.Minute))
+	if s := state(); s.active || s.notified {
+		t.Errorf("after the cooldown: %+v", s)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+)
+
+var backfillWeather = flag.Duration("backfill-weather", 0, "at startup, fetch this much past weather (e.g. 3h) to seed history and daily aggregates")
+
+// backfillTimeout bounds the backfill, which delays startup.
+var backfillTimeout = 30 * time.Second
+
+// WeatherBackfiller is implemented by weather providers that can return
+// past observations, oldest first.
+type WeatherBackfiller interface {
+	Backfill(ctx context.Context, from, to time.Time) ([]Observation, error)
+}
+
+// weatherCoveredUntil returns the time of the newest weather sample that
+// was already restored from the state file or the SQLite log.
+func weatherCoveredUntil(from time.Time) time.Time {
+	until := currentSnapshot().WeatherStamp
+	if sqliteDB != nil {
+		samples, err := querySQLite(from, time.Now(), sourceWeather, "")
+		if err != nil {
+			log.Printf("error: backfill: %v", err)
+		}
+		if n := len(samples); n > 0 && samples[n-1].Time.After(until) {
+			until = samples[n-1].Time
+		}
+	}
+	return until
+}
+
+// runWeatherBackfill seeds the history and daily aggregates with the last
+// -backfill-weather of observations. Observations not newer than what is
+// already known are skipped, so nothing is counted twice, as are those
+// with missing or implausible fields, since there is no previous value to
+// fall back to. Failures are logged and otherwise ignored.
+func runWeatherBackfill(provider WeatherProvider) {
+	if *backfillWeather <= 0 {
+		return
+	}
+	backfiller, ok := provider.(WeatherBackfiller)
+	if !ok {
+		log.Printf("warning: weather provider does not support backfill, skipping")
+		return
+	}
+	now := time.Now()
+	from := now.Add(-*backfillWeather)
+	ctx, cancel := context.WithTimeout(context.Background(), backfillTimeout)
+	defer cancel()
+	observations, err := backfiller.Backfill(ctx, from, now)
+	if err != nil {
+		log.Printf("error: backfill: %v", err)
+		return
+	}
+	coveredUntil := weatherCoveredUntil(from)
+	n := 0
+	for _, obs := range observations {
+		if obs.ObservedAt.IsZero() || !obs.ObservedAt.After(coveredUntil) || emptyWeather(obs) {
+			continue
+		}
+		obs, ok := validateWeather(calibrateObservation(obs), Observation{})
+		if !ok {
+			continue
+		}
+		s := weatherSample(obs, obs.ObservedAt)
+		s.Backfilled = true
+		updateDailyAggregates(s)
+		addHistorySample(s)
+		n++
+	}
+	log.Printf("backfilled %d of %d weather observations since %v", n, len(observations), from)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeBackfiller struct {
+	staticWeather
+	observations []Observation
+	hang         bool
+}
+
+func (b *fakeBackfiller) Backfill(ctx context.Context, from, to time.Time) ([]Observation, error) {
+	if b.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return b.observations, nil
+}
+
+func TestWeatherBackfill(t *testing.T) {
+	initHistory()
+	saved := *backfillWeather
+	*backfillWeather = 3 * time.Hour
+	defer func() { *backfillWeather = saved }()
+
+	now := time.Now()
+	currentDataMutex.Lock()
+	savedWeatherTime := currentWeatherTime
+	currentWeatherTime = now.Add(-90 * time.Minute) // restored from the state file
+	currentDataMutex.Unlock()
+	defer func() {
+		currentDataMutex.Lock()
+		currentWeatherTime = savedWeatherTime
+		currentDataMutex.Unlock()
+	}()
+
+	b := &fakeBackfiller{observations: []Observation{
+		{Temperature: 1, Humidity: 80, Pressure: 1010, ObservedAt: now.Add(-150 * time.Minute)},
+		{Temperature: 2, Humidity: 80, Pressure: 1010, ObservedAt: now.Add(-90 * time.Minute)},
+		{Temperature: 3, Humidity: 80, Pressure: 1010, ObservedAt: now.Add(-30 * time.Minute)},
+		{ObservedAt: now.Add(-20 * time.Minute)}, // empty
+		{Temperature: 4, Pressure: 1010, ObservedAt: now.Add(-15 * time.Minute), missing: []string{"outside_humidity"}},
+		{Temperature: 5, Humidity: 80, Pressure: 2000, ObservedAt: now.Add(-10 * time.Minute)},
+	}}
+	runWeatherBackfill(b)
+
+	historyMutex.Lock()
+	points := historyTiers[0].query(now.Add(-4*time.Hour), now, sourceWeather, "")
+	historyMutex.Unlock()
+	if len(points) != 1 {
+		t.Fatalf("got %d history points, want only the valid one after the restored state", len(points))
+	}
+	if !points[0].Backfilled || points[0].Values["temperature"].Mean != 3 {
+		t.Errorf("unexpected point %+v", points[0])
+	}
+}
+
+func TestWeatherBackfillTimeout(t *testing.T) {
+	saved, savedTimeout := *backfillWeather, backfillTimeout
+	*backfillWeather, backfillTimeout = time.Hour, 50*time.Millisecond
+	defer func() { *backfillWeather, backfillTimeout = saved, savedTimeout }()
+
+	done := make(chan struct{})
+	go func() {
+		runWeatherBackfill(&fakeBackfiller{hang: true})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backfill did not give up on a hanging history API")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var calibrateIndoorTemp = flag.Float64("calibrate-indoor-temp", 0, "offset (°C) added to the indoor temperature")
+var calibrateIndoorHumidity = flag.Float64("calibrate-indoor-humidity", 0, "offset (%) added to the indoor humidity")
+var calibrateOutdoorTemp = flag.Float64("calibrate-outdoor-temp", 0, "offset (°C) added to the outdoor temperature")
+var calibrateOutdoorHumidity = flag.Float64("calibrate-outdoor-humidity", 0, "offset (%) added to the outdoor humidity")
+var calibrateOutdoorPressure = flag.Float64("calibrate-outdoor-pressure", 0, "offset (hPa) added to the outdoor pressure")
+
+// calibrationOffsets maps metric names to their offset flags, for the
+// *_calibration_offset gauges and /debug/config.
+func calibrationOffsets() map[string]float64 {
+	return map[string]float64{
+		"env_temperature":     *calibrateIndoorTemp,
+		"env_humidity":        *calibrateIndoorHumidity,
+		"outside_temperature": *calibrateOutdoorTemp,
+		"outside_humidity":    *calibrateOutdoorHumidity,
+		"outside_pressure":    *calibrateOutdoorPressure,
+	}
+}
+
+// registerCalibrationMetrics exports each non-zero offset as a constant
+// gauge. Call it after flag.Parse.
+func registerCalibrationMetrics() {
+	for name, offset := range calibrationOffsets() {
+		if offset == 0 {
+			continue
+		}
+		g := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: name + "_calibration_offset",
+			Help: "Calibration offset applied to " + name + ".",
+		})
+		g.Set(offset)
+		prometheus.MustRegister(g)
+	}
+}
+
+func clampHumidity(h float64) float64 {
+	if h < 0 {
+		return 0
+	}
+	if h > 100 {
+		return 100
+	}
+	return h
+}
+
+// calibrateReading applies the indoor offsets. It is called once per fetch
+// before the reading is stored, so everything downstream sees corrected
+// values.
+func calibrateReading(ts Reading) Reading {
+	ts.CurrentTemperature += *calibrateIndoorTemp
+	if *calibrateIndoorHumidity != 0 {
+		ts.CurrentHumidity = clampHumidity(ts.CurrentHumidity + *calibrateIndoorHumidity)
+	}
+	return ts
+}
+
+// calibrateObservation applies the outdoor offsets, see calibrateReading.
+func calibrateObservation(obs Observation) Observation {
+	obs.Temperature += *calibrateOutdoorTemp
+	if *calibrateOutdoorHumidity != 0 {
+		obs.Humidity = clampHumidity(obs.Humidity + *calibrateOutdoorHumidity)
+	}
+	obs.Pressure += *calibrateOutdoorPressure
+	return obs
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// setFloatFlags sets the given flag values for the duration of the test.
+func setFloatFlags(t *testing.T, values map[*float64]float64) {
+	t.Helper()
+	saved := map[*float64]float64{}
+	for p, v := range values {
+		saved[p] = *p
+		*p = v
+	}
+	t.Cleanup(func() {
+		for p, v := range saved {
+			*p = v
+		}
+	})
+}
+
+func TestCalibrateReading(t *testing.T) {
+	setFloatFlags(t, map[*float64]float64{calibrateIndoorTemp: -0.8, calibrateIndoorHumidity: 5})
+	tests := []struct {
+		in, want Reading
+	}{
+		{Reading{CurrentTemperature: 21.3, CurrentHumidity: 40, TargetTemperature: 21}, Reading{CurrentTemperature: 20.5, CurrentHumidity: 45, TargetTemperature: 21}},
+		{Reading{CurrentTemperature: 0, CurrentHumidity: 97, TargetTemperature: 18}, Reading{CurrentTemperature: -0.8, CurrentHumidity: 100, TargetTemperature: 18}},
+	}
+	for _, tt := range tests {
+		got := calibrateReading(tt.in)
+		if math.Abs(got.CurrentTemperature-tt.want.CurrentTemperature) > 1e-9 || got.CurrentHumidity != tt.want.CurrentHumidity ||
+			got.TargetTemperature != tt.want.TargetTemperature {
+			t.Errorf("calibrateReading(%+v) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCalibrateObservation(t *testing.T) {
+	setFloatFlags(t, map[*float64]float64{calibrateOutdoorTemp: 1.5, calibrateOutdoorHumidity: -10, calibrateOutdoorPressure: 2.5})
+	tests := []struct {
+		in, want Observation
+	}{
+		{Observation{Temperature: 10, Humidity: 60, Pressure: 1010}, Observation{Temperature: 11.5, Humidity: 50, Pressure: 1012.5}},
+		{Observation{Temperature: -1.5, Humidity: 4, Pressure: 990}, Observation{Temperature: 0, Humidity: 0, Pressure: 992.5}},
+	}
+	for _, tt := range tests {
+		got := calibrateObservation(tt.in)
+		if got.Temperature != tt.want.Temperature || got.Humidity != tt.want.Humidity || got.Pressure != tt.want.Pressure {
+			t.Errorf("calibrateObservation(%+v) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCalibrationWithoutOffsets(t *testing.T) {
+	setFloatFlags(t, map[*float64]float64{calibrateIndoorTemp: 0, calibrateIndoorHumidity: 0})
+	// Without an offset, humidity is passed on as is, even if out of range,
+	// so that validation can reject it.
+	if got := calibrateReading(Reading{CurrentHumidity: 140}); got.CurrentHumidity != 140 {
+		t.Errorf("humidity changed to %v without an offset", got.CurrentHumidity)
+	}
+}
+
+func TestSeaLevelPressureUsesCalibratedTemperature(t *testing.T) {
+	setFloatFlags(t, map[*float64]float64{calibrateOutdoorTemp: -5, calibrateOutdoorPressure: 1.24, stationElevation: 1000})
+	saved := seaLevelCorrection
+	seaLevelCorrection = true
+	defer func() { seaLevelCorrection = saved }()
+
+	if err := collectWeather(context.Background(), &staticWeather{obs: Observation{Temperature: 13.5, Humidity: 60, Pressure: 897.52}}); err != nil {
+		t.Fatal(err)
+	}
+	// 8.5 °C and 898.76 hPa after calibration is the standard atmosphere at
+	// 1000 m.
+	if got := testutil.ToFloat64(promOutsidePressureSeaLevel); math.Abs(got-1013.25) > 0.2 {
+		t.Errorf("outside_pressure_sea_level_corrected = %.2f, want 1013.25", got)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var collectEnable = flag.String("collect.enable", "", "comma-separated metric groups to export, or prefixes like \"weather\" (default: all)")
+var collectDisable = flag.String("collect.disable", "", "comma-separated metric groups, or prefixes, not to export")
+
+// collectGroups maps each metric group to its collectors. Groups are
+// declared by the files owning the metrics and registered by
+// setupCollectGroups.
+var collectGroups = map[string][]prometheus.Collector{}
+
+// activeCollectGroups is the set of groups being exported.
+var activeCollectGroups = map[string]bool{}
+
+func collectGroup(group string, cs ...prometheus.Collector) {
+	collectGroups[group] = append(collectGroups[group], cs...)
+}
+
+func collectGroupNames() []string {
+	var names []string
+	for name := range collectGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matchCollectGroups returns the groups called name or starting with name
+// followed by a dot.
+func matchCollectGroups(name string) ([]string, error) {
+	var matched []string
+	for _, group := range collectGroupNames() {
+		if group == name || strings.HasPrefix(group, name+".") {
+			matched = append(matched, group)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("unknown metric group %q, valid groups: %s", name, strings.Join(collectGroupNames(), ", "))
+	}
+	return matched, nil
+}
+
+// setupCollectGroups applies -collect.enable and -collect.disable and
+// registers the metrics of the active groups. Call it after flag.Parse.
+func setupCollectGroups() error {
+	active := map[string]bool{}
+	if *collectEnable == "" {
+		for name := range collectGroups {
+			active[name] = true
+		}
+	}
+	for _, name := range splitList(*collectEnable) {
+		groups, err := matchCollectGroups(name)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			active[group] = true
+		}
+	}
+	for _, name := range splitList(*collectDisable) {
+		groups, err := matchCollectGroups(name)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			delete(active, group)
+		}
+	}
+	for group := range active {
+		for _, c := range collectGroups[group] {
+			prometheus.MustRegister(c)
+		}
+	}
+	activeCollectGroups = active
+	return nil
+}
+
+// collectEnabled reports whether the metrics of group are exported, so
+// fetches only needed for them can be skipped.
+func collectEnabled(group string) bool {
+	return activeCollectGroups[group]
+}
+
+// collectPrefixEnabled reports whether any group called prefix or starting
+// with prefix followed by a dot is exported.
+func collectPrefixEnabled(prefix string) bool {
+	for group := range activeCollectGroups {
+		if group == prefix || strings.HasPrefix(group, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func activeCollectGroupNames() []string {
+	var names []string
+	for name := range activeCollectGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
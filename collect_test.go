@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetupCollectGroupsUnknownGroup(t *testing.T) {
+	saved := *collectEnable
+	*collectEnable = "weather.humidity,weather.bogus"
+	defer func() { *collectEnable = saved }()
+
+	err := setupCollectGroups()
+	if err == nil {
+		t.Fatal("unknown group accepted")
+	}
+	for _, want := range []string{`"weather.bogus"`, strings.Join(collectGroupNames(), ", ")} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestCollectPrefixEnabled(t *testing.T) {
+	saved := activeCollectGroups
+	activeCollectGroups = map[string]bool{"thermostat.status": true, "weather.wind": true}
+	defer func() { activeCollectGroups = saved }()
+
+	for prefix, want := range map[string]bool{"weather": true, "weather.wind": true, "weather.pressure": false, "weath": false} {
+		if got := collectPrefixEnabled(prefix); got != want {
+			t.Errorf("%s: got %v, want %v", prefix, got, want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var csvOutput = flag.String("csv-output", "", "CSV file to append every sample to")
+var csvRotate = flag.String("csv-rotate", "", "rotate the CSV file: daily, monthly, or a size such as 10M")
+
+var csvHeader = []string{"timestamp", "source", "temperature", "humidity", "target", "hvac_state", "pressure", "account", "provider", "thermostat"}
+
+var promCSVWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "csv_write_errors_total",
+	Help: "Number of samples that could not be written to the CSV file.",
+})
+
+func init() {
+	prometheus.MustRegister(promCSVWriteErrors)
+}
+
+// csvRow formats s as a CSV row matching csvHeader. Missing values are left
+// empty. Downstream parsers depend on this format, so only ever append
+// columns.
+func csvRow(s Sample) []string {
+	float := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	hvacState := ""
+	if s.HvacState != nil {
+		hvacState = *s.HvacState
+	}
+	return []string{
+		s.Time.UTC().Format(time.RFC3339),
+		s.Source,
+		float(s.Temperature),
+		float(s.Humidity),
+		float(s.TargetTemperature),
+		hvacState,
+		float(s.Pressure),
+		s.Account,
+		s.Provider,
+		s.Thermostat,
+	}
+}
+
+// csvLog appends samples to a CSV file, rotating it by date or size.
+type csvLog struct {
+	path    string
+	rotate  string // "", "daily", "monthly" or "size"
+	maxSize int64
+
+	name string // currently open file
+	file *os.File
+	size int64
+}
+
+func parseCSVRotate(v string) (rotate string, maxSize int64, err error) {
+	invalid := fmt.Errorf("invalid -csv-rotate %q, want daily, monthly or a size such as 10M", v)
+	switch v {
+	case "", "none":
+		return "", 0, nil
+	case "daily", "monthly":
+		return v, 0, nil
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return "", 0, invalid
+	}
+	return "size", n * multiplier, nil
+}
+
+// fileName returns the file a sample taken at t belongs in, e.g.
+// samples-2024-05.csv for monthly rotation of samples.csv.
+func (l *csvLog) fileName(t time.Time) string {
+	ext := filepath.Ext(l.path)
+	base := strings.TrimSuffix(l.path, ext)
+	switch l.rotate {
+	case "daily":
+		return base + "-" + t.Format("2006-01-02") + ext
+	case "monthly":
+		return base + "-" + t.Format("2006-01") + ext
+	}
+	return l.path
+}
+
+func (l *csvLog) open(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.name, l.size = f, name, fi.Size()
+	if l.size == 0 {
+		return l.writeRow(csvHeader)
+	}
+	return nil
+}
+
+func (l *csvLog) close() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+func (l *csvLog) writeRow(row []string) error {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(row)
+	w.Flush()
+	n, err := l.file.WriteString(b.String())
+	l.size += int64(n)
+	return err
+}
+
+func (l *csvLog) write(s Sample) error {
+	loc := dailyLocation
+	if loc == nil {
+		loc = time.Local
+	}
+	name := l.fileName(s.Time.In(loc))
+	if l.file != nil && l.name != name {
+		l.close()
+	}
+	if l.file != nil && l.rotate == "size" && l.size >= l.maxSize {
+		l.close()
+		ext := filepath.Ext(l.path)
+		rotated := strings.TrimSuffix(l.path, ext) + "-" + time.Now().Format("20060102T150405") + ext
+		if err := os.Rename(l.path, rotated); err != nil {
+			return err
+		}
+	}
+	if l.file == nil {
+		if err := l.open(name); err != nil {
+			return err
+		}
+	}
+	return l.writeRow(csvRow(s))
+}
+
+var csvQueue = make(chan Sample, 100)
+var csvEnabled bool
+
+// openCSVLog validates the CSV flags and starts the writer. It does nothing
+// if no output file is configured.
+func openCSVLog() error {
+	if *csvOutput == "" {
+		return nil
+	}
+	rotate, maxSize, err := parseCSVRotate(*csvRotate)
+	if err != nil {
+		return err
+	}
+	l := &csvLog{path: *csvOutput, rotate: rotate, maxSize: maxSize}
+	csvEnabled = true
+	go func() {
+		for s := range csvQueue {
+			if err := l.write(s); err != nil {
+				log.Printf("error: csv: %v", err)
+				promCSVWriteErrors.Inc()
+				l.close()
+			}
+		}
+	}()
+	return nil
+}
+
+// enqueueCSVSample queues s for writing without blocking; if the writer
+// can't keep up the sample is dropped and counted as a write error.
+func enqueueCSVSample(s Sample) {
+	if !csvEnabled {
+		return
+	}
+	select {
+	case csvQueue <- s:
+	default:
+		log.Printf("error: csv: queue full, dropping %s sample", s.Source)
+		promCSVWriteErrors.Inc()
+	}
+}
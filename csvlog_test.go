@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestCSVGolden(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	windSpeed := 4.6
+	samples := []Sample{
+		thermostatSample(Reading{
+			Account:            "home",
+			Provider:           "nest",
+			DeviceID:           "abc123",
+			CurrentHumidity:    45,
+			CurrentTemperature: 21.5,
+			TargetTemperature:  20,
+			HvacState:          "heating",
+		}, at),
+		weatherSample(Observation{Temperature: -2.25, Humidity: 80, Pressure: 1013.2, WindSpeed: &windSpeed}, at.Add(time.Minute)),
+		// Nothing but the identifying columns, and a name that needs quoting.
+		{Time: at.Add(2 * time.Minute), Source: sourceThermostat, Account: "cabin", Provider: "ecobee", Thermostat: "Main Floor, East"},
+	}
+
+	path := filepath.Join(t.TempDir(), "samples.csv")
+	l := &csvLog{path: path}
+	for _, s := range samples {
+		if err := l.write(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.close()
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "samples.csv.golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("CSV output changed, downstream parsers may break.\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseCSVRotate(t *testing.T) {
+	tests := []struct {
+		in      string
+		rotate  string
+		maxSize int64
+		wantErr bool
+	}{
+		{"", "", 0, false},
+		{"none", "", 0, false},
+		{"daily", "daily", 0, false},
+		{"monthly", "monthly", 0, false},
+		{"1000", "size", 1000, false},
+		{"10k", "size", 10 << 10, false},
+		{"10M", "size", 10 << 20, false},
+		{"2G", "size", 2 << 30, false},
+		{"weekly", "", 0, true},
+		{"0M", "", 0, true},
+		{"-5", "", 0, true},
+		{"M", "", 0, true},
+	}
+	for _, tt := range tests {
+		rotate, maxSize, err := parseCSVRotate(tt.in)
+		if (err != nil) != tt.wantErr || rotate != tt.rotate || maxSize != tt.maxSize {
+			t.Errorf("parseCSVRotate(%q) = %q, %d, %v; want %q, %d, error %v", tt.in, rotate, maxSize, err, tt.rotate, tt.maxSize, tt.wantErr)
+		}
+	}
+}
+
+func TestCSVFileName(t *testing.T) {
+	at := time.Date(2024, 5, 7, 23, 59, 0, 0, time.UTC)
+	tests := []struct {
+		path, rotate, want string
+	}{
+		{"samples.csv", "", "samples.csv"},
+		{"samples.csv", "size", "samples.csv"},
+		{"samples.csv", "daily", "samples-2024-05-07.csv"},
+		{"samples.csv", "monthly", "samples-2024-05.csv"},
+		{"/var/log/neststats/samples", "monthly", "/var/log/neststats/samples-2024-05"},
+	}
+	for _, tt := range tests {
+		l := &csvLog{path: tt.path, rotate: tt.rotate}
+		if got := l.fileName(at); got != tt.want {
+			t.Errorf("fileName(%q, %q) = %q, want %q", tt.path, tt.rotate, got, tt.want)
+		}
+	}
+}
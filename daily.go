@@ -0,0 +1,258 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var timezone = flag.String("timezone", "Local", "time zone (IANA name) whose midnight starts a new day for daily aggregates")
+var dailyYesterdayGrace = flag.Duration("daily-yesterday-grace", 12*time.Hour, "how long after midnight the previous day's aggregates stay exported")
+
+// dailyMaxGap caps how long a single sample counts towards the daily mean,
+// so a value from before an outage doesn't dominate the average.
+const dailyMaxGap = 30 * time.Minute
+
+var dailyLocation *time.Location
+
+// dailySeries keeps the running minimum, maximum and time-weighted mean of
+// one series for the current day, and the final values of the previous
+// day.
+type dailySeries struct {
+	day         time.Time // midnight starting the current day
+	count       int
+	min, max    float64
+	weightedSum float64
+	weight      float64
+	lastValue   float64
+	lastTime    time.Time
+
+	hasYesterday                              bool
+	yesterdayMin, yesterdayMax, yesterdayMean float64
+}
+
+// dailyAggregate exports the daily statistics of one quantity, for each
+// combination of label values it has seen.
+type dailyAggregate struct {
+	mu     sync.Mutex
+	series map[string]*dailySeries
+	labels map[string][]string
+
+	todayMin, todayMax, todayMean                *prometheus.GaugeVec
+	yesterdayMinG, yesterdayMaxG, yesterdayMeanG *prometheus.GaugeVec
+}
+
+func newDailyAggregate(group, name, help string, labels []string) *dailyAggregate {
+	gauge := func(suffix, what string) *prometheus.GaugeVec {
+		g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: name + suffix,
+			Help: what + " " + help + ".",
+		}, labels)
+		collectGroup(group, g)
+		return g
+	}
+	return &dailyAggregate{
+		series:         map[string]*dailySeries{},
+		labels:         map[string][]string{},
+		todayMin:       gauge("_today_min", "Today's minimum"),
+		todayMax:       gauge("_today_max", "Today's maximum"),
+		todayMean:      gauge("_today_mean", "Today's time-weighted mean"),
+		yesterdayMinG:  gauge("_yesterday_min", "Yesterday's minimum"),
+		yesterdayMaxG:  gauge("_yesterday_max", "Yesterday's maximum"),
+		yesterdayMeanG: gauge("_yesterday_mean", "Yesterday's time-weighted mean"),
+	}
+}
+
+var (
+	dailyTemperature        = newDailyAggregate("daily.thermostat.temperature", "env_temperature", "temperature", thermostatLabels)
+	dailyHumidity           = newDailyAggregate("daily.thermostat.humidity", "env_humidity", "humidity", thermostatLabels)
+	dailyOutsideTemperature = newDailyAggregate("daily.weather.temperature", "outside_temperature", "temperature (outside)", nil)
+)
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.In(dailyLocation).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, dailyLocation)
+}
+
+func (a *dailyAggregate) add(labelValues []string, v float64, t time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := strings.Join(labelValues, "\x00")
+	s, ok := a.series[key]
+	if !ok {
+		s = &dailySeries{}
+		a.series[key] = s
+		a.labels[key] = labelValues
+	}
+	s.rollover(t)
+	if t.Before(s.day) || (s.count > 0 && !t.After(s.lastTime)) {
+		return
+	}
+	if s.count == 0 {
+		s.min, s.max = v, v
+	} else {
+		if v < s.min {
+			s.min = v
+		}
+		if v > s.max {
+			s.max = v
+		}
+		dt := t.Sub(s.lastTime)
+		if dt > dailyMaxGap {
+			dt = dailyMaxGap
+		}
+		s.weightedSum += s.lastValue * dt.Seconds()
+		s.weight += dt.Seconds()
+	}
+	s.lastValue, s.lastTime = v, t
+	s.count++
+	a.export(key)
+}
+
+func (s *dailySeries) mean() float64 {
+	if s.weight == 0 {
+		return s.lastValue
+	}
+	return s.weightedSum / s.weight
+}
+
+// rollover starts a new day if now is past the current one. The finished
+// day becomes yesterday only if it really was the day before; after a
+// longer gap there is nothing to report for yesterday.
+func (s *dailySeries) rollover(now time.Time) {
+	today := midnight(now)
+	if s.day.IsZero() {
+		s.day = today
+		return
+	}
+	if today.After(s.day) {
+		y, m, d := today.Date()
+		previous := time.Date(y, m, d-1, 0, 0, 0, 0, dailyLocation)
+		s.hasYesterday = s.count > 0 && s.day.Equal(previous)
+		if s.hasYesterday {
+			s.yesterdayMin, s.yesterdayMax, s.yesterdayMean = s.min, s.max, s.mean()
+		}
+		s.day = today
+		s.count = 0
+		s.weightedSum, s.weight = 0, 0
+	}
+	if s.hasYesterday && now.Sub(s.day) > *dailyYesterdayGrace {
+		s.hasYesterday = false
+	}
+}
+
+func (a *dailyAggregate) tick(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, s := range a.series {
+		s.rollover(now)
+		a.export(key)
+	}
+}
+
+// remove forgets the series with the given label values.
+func (a *dailyAggregate) remove(labelValues []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := strings.Join(labelValues, "\x00")
+	if _, ok := a.series[key]; !ok {
+		return
+	}
+	delete(a.series, key)
+	delete(a.labels, key)
+	for _, g := range []*prometheus.GaugeVec{a.todayMin, a.todayMax, a.todayMean, a.yesterdayMinG, a.yesterdayMaxG, a.yesterdayMeanG} {
+		g.DeleteLabelValues(labelValues...)
+	}
+}
+
+func (a *dailyAggregate) export(key string) {
+	s, lv := a.series[key], a.labels[key]
+	if s.count > 0 {
+		a.todayMin.WithLabelValues(lv...).Set(s.min)
+		a.todayMax.WithLabelValues(lv...).Set(s.max)
+		a.todayMean.WithLabelValues(lv...).Set(s.mean())
+	} else {
+		a.todayMin.DeleteLabelValues(lv...)
+		a.todayMax.DeleteLabelValues(lv...)
+		a.todayMean.DeleteLabelValues(lv...)
+	}
+	if s.hasYesterday {
+		a.yesterdayMinG.WithLabelValues(lv...).Set(s.yesterdayMin)
+		a.yesterdayMaxG.WithLabelValues(lv...).Set(s.yesterdayMax)
+		a.yesterdayMeanG.WithLabelValues(lv...).Set(s.yesterdayMean)
+	} else {
+		a.yesterdayMinG.DeleteLabelValues(lv...)
+		a.yesterdayMaxG.DeleteLabelValues(lv...)
+		a.yesterdayMeanG.DeleteLabelValues(lv...)
+	}
+}
+
+func updateDailyAggregates(s Sample) {
+	if dailyLocation == nil {
+		return
+	}
+	switch s.Source {
+	case sourceThermostat:
+		labelValues := []string{s.Account, s.Provider, s.Thermostat}
+		if s.Temperature != nil {
+			dailyTemperature.add(labelValues, *s.Temperature, s.Time)
+		}
+		if s.Humidity != nil {
+			dailyHumidity.add(labelValues, *s.Humidity, s.Time)
+		}
+	case sourceWeather:
+		if s.Temperature != nil {
+			dailyOutsideTemperature.add(nil, *s.Temperature, s.Time)
+		}
+	}
+}
+
+// startDailyAggregates loads -timezone, seeds the aggregates with what was
+// recorded since yesterday's midnight and starts rolling them over at
+// midnight. Seeding uses the SQLite log if enabled, and falls back to the
+// restored state file otherwise.
+func startDailyAggregates() error {
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return err
+	}
+	dailyLocation = loc
+
+	now := time.Now()
+	y, m, d := now.In(loc).Date()
+	since := time.Date(y, m, d-1, 0, 0, 0, 0, loc)
+	if sqliteDB != nil {
+		samples, err := querySQLite(since, now, "", "")
+		if err != nil {
+			log.Printf("error: seeding daily aggregates: %v", err)
+		}
+		for _, s := range samples {
+			updateDailyAggregates(s)
+		}
+	} else {
+		data := currentSnapshot()
+		for _, ad := range data.Accounts {
+			if ad.Stamp.After(since) {
+				for _, ts := range ad.Thermostats {
+					updateDailyAggregates(thermostatSample(ts, ad.Stamp))
+				}
+			}
+		}
+		if data.WeatherStamp.After(since) {
+			updateDailyAggregates(weatherSample(data.WeatherData, data.WeatherStamp))
+		}
+	}
+
+	go func() {
+		for t := range time.NewTicker(time.Minute).C {
+			dailyTemperature.tick(t)
+			dailyHumidity.tick(t)
+			dailyOutsideTemperature.tick(t)
+		}
+	}()
+	return nil
+}
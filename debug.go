@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+)
+
+// secretFlags are not shown on /debug/config.
+var secretFlags = map[string]bool{
+	"client-secret":        true,
+	"owm-apikey":           true,
+	"ecobee-apikey":        true,
+	"ecobee-refresh-token": true,
+	"write-api-token":      true,
+	"alert-webhook-url":    true,
+}
+
+// httpDebugConfigHandler shows the effective configuration.
+func httpDebugConfigHandler(w http.ResponseWriter, req *http.Request) {
+	flags := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = "<redacted>"
+		}
+		flags[f.Name] = v
+	})
+	b, _ := json.MarshalIndent(struct {
+		Flags       map[string]string  `json:"flags"`
+		Calibration map[string]float64 `json:"calibration"`
+		Collect     []string           `json:"collect"`
+	}{flags, calibrationOffsets(), activeCollectGroupNames()}, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ecobeeAPIKey = flag.String("ecobee-apikey", "", "ecobee application API key")
+var ecobeeRefreshToken = flag.String("ecobee-refresh-token", "", "ecobee refresh token; without one, a PIN to authorize neststats is logged")
+var ecobeeTokenFile = flag.String("ecobee-token-file", "", "file to keep the current ecobee refresh token in, as ecobee rotates it on every refresh")
+var ecobeeThermostatIDs = flag.String("ecobee-thermostat-ids", "", "comma-separated ecobee thermostat identifiers (default: all registered thermostats)")
+
+const ecobeeBaseURL = "https://api.ecobee.com"
+
+// ecobee reports this status code when the access token has expired.
+const ecobeeTokenExpired = 14
+
+type ecobeeTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type ecobeePinResponse struct {
+	EcobeePin string `json:"ecobeePin"`
+	Code      string `json:"code"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+type ecobeeThermostatResponse struct {
+	ThermostatList []struct {
+		Identifier string `json:"identifier"`
+		Settings   struct {
+			HvacMode string `json:"hvacMode"`
+		} `json:"settings"`
+		Runtime struct {
+			ActualTemperature float64 `json:"actualTemperature"`
+			ActualHumidity    float64 `json:"actualHumidity"`
+			DesiredHeat       float64 `json:"desiredHeat"`
+			DesiredCool       float64 `json:"desiredCool"`
+		} `json:"runtime"`
+		EquipmentStatus string `json:"equipmentStatus"`
+	} `json:"thermostatList"`
+	Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+// ecobeeProvider polls the ecobee API. Until it has a refresh token it runs
+// the PIN authorization flow: the PIN is logged, and each poll checks
+// whether it has been entered in the ecobee web portal yet.
+type ecobeeProvider struct {
+	baseURL       string
+	apiKey        string
+	thermostatIDs string
+	tokenFile     string
+
+	mu           sync.Mutex
+	accessToken  string
+	accessExpiry time.Time
+	refreshToken string
+	pinCode      string
+	pinExpiry    time.Time
+}
+
+func init() {
+	registerThermostatProvider("ecobee", func(cfg AccountConfig) (ThermostatProvider, error) {
+		if cfg.EcobeeAPIKey == "" {
+			return nil, errors.New("ecobee: API key missing")
+		}
+		p := &ecobeeProvider{
+			baseURL:       ecobeeBaseURL,
+			apiKey:        cfg.EcobeeAPIKey,
+			thermostatIDs: strings.Join(cfg.ThermostatIDs, ","),
+			tokenFile:     cfg.EcobeeTokenFile,
+			refreshToken:  cfg.EcobeeRefreshToken,
+		}
+		if p.tokenFile != "" {
+			b, err := ioutil.ReadFile(p.tokenFile)
+			if err == nil && strings.TrimSpace(string(b)) != "" {
+				p.refreshToken = strings.TrimSpace(string(b))
+			} else if err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("ecobee: %v", err)
+			}
+		}
+		return p, nil
+	})
+}
+
+// ecobeeToCelsius converts ecobee's tenths of a degree Fahrenheit to °C.
+func ecobeeToCelsius(tenthsF float64) float64 {
+	return (tenthsF/10 - 32) * 5 / 9
+}
+
+// ecobeeHvacState maps an equipmentStatus list such as "heatPump,fan" to
+// the hvac_state values used by Nest.
+func ecobeeHvacState(equipmentStatus string) string {
+	for _, eq := range strings.Split(equipmentStatus, ",") {
+		switch {
+		case strings.HasPrefix(eq, "heatPump"), strings.HasPrefix(eq, "auxHeat"):
+			return "heating"
+		case strings.HasPrefix(eq, "compCool"):
+			return "cooling"
+		}
+	}
+	return "off"
+}
+
+// ecobeeTarget picks the setpoint that currently applies: the cooling one
+// in cool mode, or in auto mode while cooling, and the heating one
+// otherwise.
+func ecobeeTarget(hvacMode, hvacState string, desiredHeat, desiredCool float64) float64 {
+	if hvacMode == "cool" || (hvacMode == "auto" && hvacState == "cooling") {
+		return ecobeeToCelsius(desiredCool)
+	}
+	return ecobeeToCelsius(desiredHeat)
+}
+
+func (p *ecobeeProvider) Fetch(ctx context.Context) ([]Reading, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.ensureToken(ctx); err != nil {
+		return nil, err
+	}
+	result, err := p.fetchThermostats(ctx)
+	if err == nil && result.Status.Code == ecobeeTokenExpired {
+		p.accessToken = ""
+		if err := p.ensureToken(ctx); err != nil {
+			return nil, err
+		}
+		result, err = p.fetchThermostats(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result.Status.Code != 0 {
+		return nil, fmt.Errorf("ecobee: status %d: %s", result.Status.Code, result.Status.Message)
+	}
+
+	var readings []Reading
+	for _, t := range result.ThermostatList {
+		hvacState := ecobeeHvacState(t.EquipmentStatus)
+		readings = append(readings, Reading{
+			Provider:           "ecobee",
+			DeviceID:           t.Identifier,
+			CurrentHumidity:    t.Runtime.ActualHumidity,
+			CurrentTemperature: ecobeeToCelsius(t.Runtime.ActualTemperature),
+			TargetTemperature:  ecobeeTarget(t.Settings.HvacMode, hvacState, t.Runtime.DesiredHeat, t.Runtime.DesiredCool),
+			HvacState:          hvacState,
+		})
+	}
+	return readings, nil
+}
+
+func (p *ecobeeProvider) fetchThermostats(ctx context.Context) (ecobeeThermostatResponse, error) {
+	var result ecobeeThermostatResponse
+
+	selection := map[string]interface{}{
+		"selectionType":          "registered",
+		"selectionMatch":         "",
+		"includeRuntime":         true,
+		"includeSettings":        true,
+		"includeEquipmentStatus": true,
+	}
+	if p.thermostatIDs != "" {
+		selection["selectionType"] = "thermostats"
+		selection["selectionMatch"] = p.thermostatIDs
+	}
+	body, _ := json.Marshal(map[string]interface{}{"selection": selection})
+
+	req, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+"/1/thermostat?format=json&json="+url.QueryEscape(string(body)), nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Add("Content-Type", "application/json;charset=UTF-8")
+	req.Header.Add("Authorization", "Bearer "+p.accessToken)
+	req = traceRequest(req, "ecobee")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return result, err
+	}
+
+	if *doDebug {
+		log.Printf("json: %s", b)
+	}
+
+	if err := json.Unmarshal(b, &result); err != nil {
+		return result, fmt.Errorf("ecobee: %s: %v", resp.Status, err)
+	}
+	return result, nil
+}
+
+// ensureToken makes sure p.accessToken is usable, refreshing it or
+// continuing the PIN flow as needed. Must be called with p.mu held.
+func (p *ecobeeProvider) ensureToken(ctx context.Context) error {
+	if p.accessToken != "" && time.Now().Before(p.accessExpiry) {
+		return nil
+	}
+	if p.refreshToken != "" {
+		return p.requestToken(ctx, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {p.refreshToken},
+			"client_id":     {p.apiKey},
+		})
+	}
+
+	if p.pinCode == "" || time.Now().After(p.pinExpiry) {
+		if err := p.requestPin(ctx); err != nil {
+			return err
+		}
+		return errors.New("ecobee: waiting for PIN authorization")
+	}
+	err := p.requestToken(ctx, url.Values{
+		"grant_type": {"ecobeePin"},
+		"code":       {p.pinCode},
+		"client_id":  {p.apiKey},
+	})
+	if err != nil {
+		return err
+	}
+	p.pinCode = ""
+	log.Printf("ecobee: PIN authorization succeeded")
+	return nil
+}
+
+func (p *ecobeeProvider) requestPin(ctx context.Context) error {
+	u := p.baseURL + "/authorize?response_type=ecobeePin&scope=smartWrite&client_id=" + url.QueryEscape(p.apiKey)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var pin ecobeePinResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pin); err != nil {
+		return fmt.Errorf("ecobee: requesting PIN: %s: %v", resp.Status, err)
+	}
+	if pin.Code == "" {
+		return fmt.Errorf("ecobee: requesting PIN: %s", resp.Status)
+	}
+	p.pinCode = pin.Code
+	p.pinExpiry = time.Now().Add(time.Duration(pin.ExpiresIn) * time.Minute)
+	log.Printf("ecobee: enter PIN %s under My Apps in the ecobee web portal to authorize neststats (valid for %d minutes)", pin.EcobeePin, pin.ExpiresIn)
+	return nil
+}
+
+func (p *ecobeeProvider) requestToken(ctx context.Context, params url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/token?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var token ecobeeTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("ecobee: token: %s: %v", resp.Status, err)
+	}
+	if token.Error != "" {
+		return fmt.Errorf("ecobee: token: %s: %s", token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("ecobee: token: %s", resp.Status)
+	}
+
+	p.accessToken = token.AccessToken
+	// Refresh a minute early rather than have a poll fail.
+	p.accessExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	if token.RefreshToken != "" && token.RefreshToken != p.refreshToken {
+		p.refreshToken = token.RefreshToken
+		if p.tokenFile != "" {
+			if err := writeFileAtomic(p.tokenFile, []byte(p.refreshToken+"\n")); err != nil {
+				log.Printf("error: ecobee: saving refresh token: %v", err)
+			}
+		} else {
+			log.Printf("warning: ecobee: refresh token rotated but no -ecobee-token-file set, it will be lost on restart")
+		}
+	}
+	return nil
+}
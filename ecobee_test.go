@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 0.005
+}
+
+func TestEcobeeToCelsius(t *testing.T) {
+	tests := []struct {
+		tenthsF, want float64
+	}{
+		{720, 22.22},
+		{320, 0},
+		{212 * 10, 100},
+		{0, -17.78},
+		{-400, -40},
+		{-4, -18},
+		{705, 21.39},
+	}
+	for _, tt := range tests {
+		if got := ecobeeToCelsius(tt.tenthsF); !approxEqual(got, tt.want) {
+			t.Errorf("ecobeeToCelsius(%v) = %v, want %v", tt.tenthsF, got, tt.want)
+		}
+	}
+}
+
+func TestEcobeeHvacState(t *testing.T) {
+	tests := []struct {
+		equipmentStatus, want string
+	}{
+		{"heatPump2", "heating"},
+		{"auxHeat1", "heating"},
+		{"heatPump,fan", "heating"},
+		{"compCool1", "cooling"},
+		{"fan,compCool2", "cooling"},
+		{"fan", "off"},
+		{"", "off"},
+	}
+	for _, tt := range tests {
+		if got := ecobeeHvacState(tt.equipmentStatus); got != tt.want {
+			t.Errorf("ecobeeHvacState(%q) = %q, want %q", tt.equipmentStatus, got, tt.want)
+		}
+	}
+}
+
+func TestEcobeeTarget(t *testing.T) {
+	const heat, cool = 680, 770 // 20 °C and 25 °C
+	tests := []struct {
+		hvacMode, hvacState string
+		want                float64
+	}{
+		{"heat", "heating", 20},
+		{"heat", "off", 20},
+		{"cool", "cooling", 25},
+		{"cool", "off", 25},
+		{"auto", "heating", 20},
+		{"auto", "cooling", 25},
+		{"auto", "off", 20},
+	}
+	for _, tt := range tests {
+		if got := ecobeeTarget(tt.hvacMode, tt.hvacState, heat, cool); !approxEqual(got, tt.want) {
+			t.Errorf("ecobeeTarget(%q, %q) = %v, want %v", tt.hvacMode, tt.hvacState, got, tt.want)
+		}
+	}
+}
+
+func TestEcobeeFetch(t *testing.T) {
+	thermostats := readTestdata(t, "ecobee-thermostat.json")
+	tokenRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/token":
+			tokenRequests++
+			if req.URL.Query().Get("grant_type") != "refresh_token" || req.URL.Query().Get("refresh_token") != "refresh-1" {
+				t.Errorf("unexpected token request %s", req.URL.RawQuery)
+			}
+			json.NewEncoder(w).Encode(ecobeeTokenResponse{AccessToken: "access-1", RefreshToken: "refresh-1", ExpiresIn: 3600})
+		case "/1/thermostat":
+			if got := req.Header.Get("Authorization"); got != "Bearer access-1" {
+				t.Errorf("Authorization = %q", got)
+			}
+			var body struct {
+				Selection map[string]interface{} `json:"selection"`
+			}
+			if err := json.Unmarshal([]byte(req.URL.Query().Get("json")), &body); err != nil || body.Selection["selectionType"] != "registered" {
+				t.Errorf("unexpected selection %q: %v", req.URL.Query().Get("json"), err)
+			}
+			w.Write(thermostats)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+
+	p := &ecobeeProvider{baseURL: srv.URL, apiKey: "key", refreshToken: "refresh-1"}
+	readings, err := p.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenRequests != 1 {
+		t.Errorf("%d token requests, want 1", tokenRequests)
+	}
+	want := []Reading{
+		{Provider: "ecobee", DeviceID: "318324702718", CurrentHumidity: 38, CurrentTemperature: 21.39, TargetTemperature: 21.11, HvacState: "heating"},
+		{Provider: "ecobee", DeviceID: "318324702719", CurrentHumidity: 52, CurrentTemperature: 25.5, TargetTemperature: 25, HvacState: "cooling"},
+	}
+	if len(readings) != len(want) {
+		t.Fatalf("got %d readings, want %d", len(readings), len(want))
+	}
+	for i, got := range readings {
+		w := want[i]
+		if got.Provider != w.Provider || got.DeviceID != w.DeviceID || got.HvacState != w.HvacState || got.CurrentHumidity != w.CurrentHumidity ||
+			!approxEqual(got.CurrentTemperature, w.CurrentTemperature) || !approxEqual(got.TargetTemperature, w.TargetTemperature) {
+			t.Errorf("reading %d: got %+v, want %+v", i, got, w)
+		}
+	}
+
+	// The access token is reused while it is valid.
+	if _, err := p.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tokenRequests != 1 {
+		t.Errorf("%d token requests after second fetch, want 1", tokenRequests)
+	}
+}
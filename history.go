@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var historyRawRetention = flag.Duration("history-raw-retention", 6*time.Hour, "how long to keep full-resolution samples in memory")
+var historyRawMaxSamples = flag.Int("history-raw-max-samples", 2000, "maximum number of full-resolution samples kept in memory per series")
+var history5mRetention = flag.Duration("history-5m-retention", 7*24*time.Hour, "how long to keep 5-minute aggregates in memory")
+var historyHorizon = flag.Duration("history-horizon", 30*24*time.Hour, "how long to keep hourly aggregates in memory")
+
+// HistoryStat summarizes the values of one field within a bucket. For raw
+// samples all three are the same.
+type HistoryStat struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	sum  float64
+}
+
+// HistoryPoint is a raw sample or an aggregated bucket, starting at Time.
+type HistoryPoint struct {
+	Time       time.Time               `json:"timestamp"`
+	Source     string                  `json:"source"`
+	Account    string                  `json:"account,omitempty"`
+	Thermostat string                  `json:"thermostat,omitempty"`
+	Count      int                     `json:"count"`
+	Values     map[string]*HistoryStat `json:"values"`
+	// Backfilled is set if any of the samples was fetched after the fact
+	// at startup rather than polled.
+	Backfilled bool `json:"backfilled,omitempty"`
+}
+
+func (p *HistoryPoint) add(s Sample) {
+	p.Count++
+	p.Backfilled = p.Backfilled || s.Backfilled
+	for field, v := range sampleValues(s) {
+		st, ok := p.Values[field]
+		if !ok {
+			p.Values[field] = &HistoryStat{Min: v, Max: v, Mean: v, sum: v}
+			continue
+		}
+		if v < st.Min {
+			st.Min = v
+		}
+		if v > st.Max {
+			st.Max = v
+		}
+		st.sum += v
+		st.Mean = st.sum / float64(p.Count)
+	}
+}
+
+func sampleValues(s Sample) map[string]float64 {
+	values := map[string]float64{}
+	if s.Temperature != nil {
+		values["temperature"] = *s.Temperature
+	}
+	if s.Humidity != nil {
+		values["humidity"] = *s.Humidity
+	}
+	if s.TargetTemperature != nil {
+		values["target_temperature"] = *s.TargetTemperature
+	}
+	if s.Pressure != nil {
+		values["pressure"] = *s.Pressure
+	}
+	return values
+}
+
+// historyTier holds the points of one resolution, per series. A width of
+// zero keeps raw samples; otherwise samples are aggregated into buckets of
+// that width, the newest of which is still open.
+type historyTier struct {
+	name      string
+	width     time.Duration
+	retention time.Duration
+	maxPoints int
+	points    map[string][]*HistoryPoint
+}
+
+func newHistoryTier(name string, width, retention time.Duration, maxPoints int) *historyTier {
+	return &historyTier{
+		name:      name,
+		width:     width,
+		retention: retention,
+		maxPoints: maxPoints,
+		points:    map[string][]*HistoryPoint{},
+	}
+}
+
+// historySeries identifies the series a sample belongs to.
+func historySeries(s Sample) string {
+	return s.Source + "\x00" + s.Account + "\x00" + s.Thermostat
+}
+
+func (t *historyTier) add(s Sample) {
+	key := historySeries(s)
+	points := t.points[key]
+	start := s.Time
+	if t.width > 0 {
+		start = s.Time.Truncate(t.width)
+	}
+	if n := len(points); t.width > 0 && n > 0 && points[n-1].Time.Equal(start) {
+		points[n-1].add(s)
+	} else {
+		p := &HistoryPoint{Time: start, Source: s.Source, Account: s.Account, Thermostat: s.Thermostat, Values: map[string]*HistoryStat{}}
+		p.add(s)
+		points = append(points, p)
+	}
+
+	cutoff := s.Time.Add(-t.retention)
+	drop := 0
+	for drop < len(points) && points[drop].Time.Before(cutoff) {
+		drop++
+	}
+	if len(points)-drop > t.maxPoints {
+		drop = len(points) - t.maxPoints
+	}
+	if drop > 0 {
+		points = append([]*HistoryPoint(nil), points[drop:]...)
+	}
+	t.points[key] = points
+}
+
+func (t *historyTier) query(from, to time.Time, source string, account string) []HistoryPoint {
+	result := []HistoryPoint{}
+	for _, points := range t.points {
+		if len(points) == 0 || (source != "" && points[0].Source != source) || (account != "" && points[0].Account != account) {
+			continue
+		}
+		for _, p := range points {
+			if !p.Time.Before(from) && !p.Time.After(to) {
+				result = append(result, copyHistoryPoint(p))
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Time.Equal(result[j].Time) {
+			return historyPointKey(result[i]) < historyPointKey(result[j])
+		}
+		return result[i].Time.Before(result[j].Time)
+	})
+	return result
+}
+
+func historyPointKey(p HistoryPoint) string {
+	return p.Source + "\x00" + p.Account + "\x00" + p.Thermostat
+}
+
+func copyHistoryPoint(p *HistoryPoint) HistoryPoint {
+	c := *p
+	c.Values = make(map[string]*HistoryStat, len(p.Values))
+	for field, st := range p.Values {
+		stCopy := *st
+		c.Values[field] = &stCopy
+	}
+	return c
+}
+
+var historyMutex sync.Mutex
+
+// historyTiers is ordered from finest to coarsest.
+var historyTiers []*historyTier
+
+func initHistory() {
+	historyTiers = []*historyTier{
+		newHistoryTier("raw", 0, *historyRawRetention, *historyRawMaxSamples),
+		newHistoryTier("5m", 5*time.Minute, *history5mRetention, int(*history5mRetention/(5*time.Minute))+1),
+		newHistoryTier("1h", time.Hour, *historyHorizon, int(*historyHorizon/time.Hour)+1),
+	}
+}
+
+func addHistorySample(s Sample) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	for _, t := range historyTiers {
+		t.add(s)
+	}
+}
+
+// removeHistorySeries drops all points of a series from every tier, so
+// devices that went away do not keep their memory.
+func removeHistorySeries(source, account, thermostat string) {
+	key := historySeries(Sample{Source: source, Account: account, Thermostat: thermostat})
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	for _, t := range historyTiers {
+		delete(t.points, key)
+	}
+}
+
+// pickHistoryTier returns the tier named by resolution, or if that is empty
+// the finest tier whose retention still reaches back to from.
+func pickHistoryTier(resolution string, from time.Time) *historyTier {
+	for _, t := range historyTiers {
+		if resolution == "" {
+			if !from.Before(time.Now().Add(-t.retention)) {
+				return t
+			}
+		} else if t.name == resolution {
+			return t
+		}
+	}
+	if resolution == "" && len(historyTiers) > 0 {
+		return historyTiers[len(historyTiers)-1]
+	}
+	return nil
+}
+
+// httpHistoryHandler serves GET /history?from=&to=&source=&account=&resolution= from
+// the in-memory history. from defaults to 24 hours ago, to to now.
+func httpHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	from, err := parseQueryTime(req.FormValue("from"), now.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseQueryTime(req.FormValue("to"), now)
+	if err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	historyMutex.Lock()
+	tier := pickHistoryTier(req.FormValue("resolution"), from)
+	if tier == nil {
+		historyMutex.Unlock()
+		http.Error(w, "invalid resolution, valid resolutions: raw, 5m, 1h", http.StatusBadRequest)
+		return
+	}
+	points := tier.query(from, to, req.FormValue("source"), req.FormValue("account"))
+	historyMutex.Unlock()
+
+	b, _ := json.Marshal(struct {
+		Resolution string         `json:"resolution"`
+		Points     []HistoryPoint `json:"points"`
+	}{tier.name, points})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type nestThermostat struct {
+	DeviceID           string   `json:"device_id"`
+	CurrentHumidity    *float64 `json:"humidity"`
+	CurrentTemperature *float64 `json:"ambient_temperature_c"`
+	TargetTemperature  *float64 `json:"target_temperature_c"`
+	HvacState          string   `json:"hvac_state"`
+	StructureID        string   `json:"structure_id"`
+	IsLocked           bool     `json:"is_locked"`
+	LockedTempMin      float64  `json:"locked_temp_min_c"`
+	LockedTempMax      float64  `json:"locked_temp_max_c"`
+}
+
+// nestProvider talks to the legacy Nest REST API. With discover set, it
+// lists all thermostats in one request, keeping only thermostatIDs if any
+// are given.
+type nestProvider struct {
+	baseURL       string
+	account       string
+	thermostatIDs []string
+	clientSecret  string
+	discover      bool
+
+	mu         sync.Mutex
+	discovered []string // IDs from the last listing
+}
+
+func init() {
+	registerThermostatProvider("nest", func(cfg AccountConfig) (ThermostatProvider, error) {
+		if cfg.ClientSecret == "" || (len(cfg.ThermostatIDs) == 0 && !cfg.Discover) {
+			return nil, errors.New("clientSecret or thermostatID missing")
+		}
+		return &nestProvider{baseURL: nestBaseURL, account: cfg.Name, thermostatIDs: cfg.ThermostatIDs, clientSecret: cfg.ClientSecret, discover: cfg.Discover}, nil
+	})
+}
+
+func headerAdder(auth string) func(req *http.Request) {
+	return func(req *http.Request) {
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", auth)
+		req.Header.Add("User-Agent", "curl/7.51.0")
+	}
+}
+
+func checkRedirectFunc(headerAdder func(*http.Request)) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		// re-add Authorization etc.
+		headerAdder(req)
+		// debug(httputil.DumpRequestOut(req, true))
+		return nil
+	}
+}
+
+func (p *nestProvider) Fetch(ctx context.Context) ([]Reading, error) {
+	if p.discover {
+		return p.fetchAll(ctx)
+	}
+	var readings []Reading
+	for _, thermostatID := range p.thermostatIDs {
+		data, err := p.downloadNest(ctx, thermostatID)
+		if err != nil {
+			return nil, err
+		}
+		readings = append(readings, nestReading(thermostatID, data))
+	}
+	return readings, nil
+}
+
+func nestReading(thermostatID string, data nestThermostat) Reading {
+	ts := Reading{
+		Provider:    "nest",
+		DeviceID:    thermostatID,
+		StructureID: data.StructureID,
+		HvacState:   data.HvacState,
+	}
+	ts.CurrentHumidity = payloadValue("humidity", data.CurrentHumidity, &ts.missing)
+	ts.CurrentTemperature = payloadValue("temperature", data.CurrentTemperature, &ts.missing)
+	ts.TargetTemperature = payloadValue("target_temperature", data.TargetTemperature, &ts.missing)
+	return ts
+}
+
+// fetchAll reads all thermostats of the account with one request.
+func (p *nestProvider) fetchAll(ctx context.Context) ([]Reading, error) {
+	status, body, err := p.request(ctx, "GET", "/devices/thermostats", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("nest: unexpected status %d: %s", status, body)
+	}
+	var devices map[string]nestThermostat
+	if err := json.Unmarshal(body, &devices); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id := range devices {
+		if len(p.thermostatIDs) == 0 || p.configured(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	p.mu.Lock()
+	p.discovered = ids
+	p.mu.Unlock()
+
+	var readings []Reading
+	for _, id := range ids {
+		readings = append(readings, nestReading(id, devices[id]))
+	}
+	return readings, nil
+}
+
+func (p *nestProvider) configured(thermostatID string) bool {
+	for _, id := range p.thermostatIDs {
+		if id == thermostatID {
+			return true
+		}
+	}
+	return false
+}
+
+// ids returns the configured thermostats, or with discovery and no
+// configured IDs, those seen in the last listing.
+func (p *nestProvider) ids() []string {
+	if len(p.thermostatIDs) > 0 || !p.discover {
+		return p.thermostatIDs
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.discovered
+}
+
+const nestBaseURL = "https://developer-api.nest.com"
+
+// request performs an authenticated request against the Nest API and
+// returns the response status and body.
+func (p *nestProvider) request(ctx context.Context, method string, path string, body []byte) (int, []byte, error) {
+	auth := "Bearer " + p.clientSecret
+	myHeaderAdder := headerAdder(auth)
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reqBody)
+
+	client := &http.Client{
+		CheckRedirect: checkRedirectFunc(myHeaderAdder),
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+	myHeaderAdder(req)
+
+	debug(httputil.DumpRequestOut(req, true))
+	req = traceRequest(req, "nest")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	updateNestRateLimit(p.account, parseNestRateLimit(resp.Header, time.Now()))
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if *doDebug {
+		log.Printf("json: %s", respBody)
+	}
+
+	return resp.StatusCode, respBody, nil
+}
+
+func (p *nestProvider) downloadNest(ctx context.Context, thermostatID string) (nestThermostat, error) {
+	var data nestThermostat
+
+	status, body, err := p.request(ctx, "GET", "/devices/thermostats/"+thermostatID, nil)
+	if err != nil {
+		return data, err
+	}
+	if status != http.StatusOK {
+		return data, fmt.Errorf("nest: unexpected status %d: %s", status, body)
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return data, err
+	}
+	return data, nil
+}
+
+// thermostat resolves thermostatID to one of the configured thermostats;
+// an empty ID is fine if there is only one.
+func (p *nestProvider) thermostat(thermostatID string) (string, error) {
+	ids := p.ids()
+	if thermostatID == "" {
+		if len(ids) == 1 {
+			return ids[0], nil
+		}
+		return "", fmt.Errorf("%w: thermostat required", errWriteRejected)
+	}
+	for _, id := range ids {
+		if id == thermostatID {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("%w: unknown thermostat %q", errWriteRejected, thermostatID)
+}
+
+// SetTarget changes target_temperature_c, refusing values outside the
+// range the thermostat is locked to.
+func (p *nestProvider) SetTarget(ctx context.Context, thermostatID string, celsius float64) (int, []byte, error) {
+	thermostatID, err := p.thermostat(thermostatID)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := p.downloadNest(ctx, thermostatID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if data.IsLocked && (celsius < data.LockedTempMin || celsius > data.LockedTempMax) {
+		return 0, nil, fmt.Errorf("%w: %v °C is outside the locked range %v..%v °C", errWriteRejected, celsius, data.LockedTempMin, data.LockedTempMax)
+	}
+	body, _ := json.Marshal(map[string]float64{"target_temperature_c": celsius})
+	return p.request(ctx, "PUT", "/devices/thermostats/"+thermostatID, body)
+}
+
+var (
+	promNestRateLimitRemaining = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nest_ratelimit_remaining",
+		Help: "Remaining Nest API calls as reported by the last response.",
+	}, []string{"account"})
+	promNestRateLimitReset = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nest_ratelimit_reset_timestamp_seconds",
+		Help: "Time at which the Nest API rate limit resets, as a Unix timestamp.",
+	}, []string{"account"})
+)
+
+func init() {
+	collectGroup("nest.ratelimit", promNestRateLimitRemaining, promNestRateLimitReset)
+}
+
+// Header names seen for the remaining budget and its reset time. Depending
+// on whether a limit blocks or only throttles, the API uses different
+// spellings; the first one present wins.
+var nestRateLimitRemainingHeaders = []string{
+	"X-RateLimit-Remaining",
+	"X-Rate-Limit-Remaining",
+	"RateLimit-Remaining",
+}
+var nestRateLimitResetHeaders = []string{
+	"X-RateLimit-Reset",
+	"X-Rate-Limit-Reset",
+	"RateLimit-Reset",
+	"Retry-After",
+}
+
+type nestRateLimit struct {
+	Remaining    float64
+	HasRemaining bool
+	Reset        time.Time
+	HasReset     bool
+}
+
+// parseNestRateLimit extracts the rate limit state from response headers.
+// Reset values may be a Unix timestamp, a number of seconds relative to now,
+// or (for Retry-After) an HTTP date.
+func parseNestRateLimit(h http.Header, now time.Time) nestRateLimit {
+	var rl nestRateLimit
+	for _, name := range nestRateLimitRemainingHeaders {
+		if v := h.Get(name); v != "" {
+			if n, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				rl.Remaining = n
+				rl.HasRemaining = true
+				break
+			}
+		}
+	}
+	for _, name := range nestRateLimitResetHeaders {
+		v := strings.TrimSpace(h.Get(name))
+		if v == "" {
+			continue
+		}
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			// Anything before 2001 can't be an absolute timestamp.
+			if n > 1000000000 {
+				rl.Reset = time.Unix(n, 0)
+			} else {
+				rl.Reset = now.Add(time.Duration(n) * time.Second)
+			}
+			rl.HasReset = true
+			break
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			rl.Reset = t
+			rl.HasReset = true
+			break
+		}
+	}
+	return rl
+}
+
+func updateNestRateLimit(account string, rl nestRateLimit) {
+	if rl.HasRemaining {
+		promNestRateLimitRemaining.WithLabelValues(account).Set(rl.Remaining)
+	} else {
+		promNestRateLimitRemaining.DeleteLabelValues(account)
+	}
+	if rl.HasReset {
+		promNestRateLimitReset.WithLabelValues(account).Set(float64(rl.Reset.Unix()))
+	} else {
+		promNestRateLimitReset.DeleteLabelValues(account)
+	}
+	if *doDebug {
+		if rl.HasRemaining || rl.HasReset {
+			log.Printf("nest rate limit (%s): remaining %v, reset at %v", account, rl.Remaining, rl.Reset)
+		} else {
+			log.Printf("nest rate limit (%s): no headers in response", account)
+		}
+	}
+}
+
+// SetAway switches the structure between home and away.
+func (p *nestProvider) SetAway(ctx context.Context, structureID string, away bool) (int, []byte, error) {
+	state := "home"
+	if away {
+		state = "away"
+	}
+	body, _ := json.Marshal(map[string]string{"away": state})
+	return p.request(ctx, "PUT", "/structures/"+structureID, body)
+}
+
+// Away returns the structure's away state; auto-away counts as away.
+func (p *nestProvider) Away(ctx context.Context, structureID string) (bool, error) {
+	status, body, err := p.request(ctx, "GET", "/structures/"+structureID+"/away", nil)
+	if err != nil {
+		return false, err
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("nest: unexpected status %d: %s", status, body)
+	}
+	var state string
+	if err := json.Unmarshal(body, &state); err != nil {
+		return false, err
+	}
+	return state != "home", nil
+}
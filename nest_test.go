@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseNestRateLimit(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    nestRateLimit
+	}{
+		{
+			name:    "X-RateLimit with absolute reset",
+			headers: map[string]string{"X-RateLimit-Remaining": "42", "X-RateLimit-Reset": "1714568400"},
+			want:    nestRateLimit{Remaining: 42, HasRemaining: true, Reset: time.Unix(1714568400, 0), HasReset: true},
+		},
+		{
+			name:    "X-Rate-Limit with relative reset",
+			headers: map[string]string{"X-Rate-Limit-Remaining": "7", "X-Rate-Limit-Reset": "60"},
+			want:    nestRateLimit{Remaining: 7, HasRemaining: true, Reset: now.Add(time.Minute), HasReset: true},
+		},
+		{
+			name:    "RateLimit",
+			headers: map[string]string{"RateLimit-Remaining": " 0 ", "RateLimit-Reset": "30"},
+			want:    nestRateLimit{Remaining: 0, HasRemaining: true, Reset: now.Add(30 * time.Second), HasReset: true},
+		},
+		{
+			name:    "Retry-After seconds",
+			headers: map[string]string{"Retry-After": "120"},
+			want:    nestRateLimit{Reset: now.Add(2 * time.Minute), HasReset: true},
+		},
+		{
+			name:    "Retry-After HTTP date",
+			headers: map[string]string{"Retry-After": "Wed, 01 May 2024 12:05:00 GMT"},
+			want:    nestRateLimit{Reset: now.Add(5 * time.Minute), HasReset: true},
+		},
+		{
+			name:    "first spelling wins",
+			headers: map[string]string{"X-RateLimit-Remaining": "5", "RateLimit-Remaining": "9"},
+			want:    nestRateLimit{Remaining: 5, HasRemaining: true},
+		},
+		{
+			name:    "garbage",
+			headers: map[string]string{"X-RateLimit-Remaining": "lots", "X-RateLimit-Reset": "soon"},
+			want:    nestRateLimit{},
+		},
+		{
+			name: "no headers",
+			want: nestRateLimit{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			got := parseNestRateLimit(h, now)
+			if got.Remaining != tt.want.Remaining || got.HasRemaining != tt.want.HasRemaining ||
+				!got.Reset.Equal(tt.want.Reset) || got.HasReset != tt.want.HasReset {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateNestRateLimitDeletesGauges(t *testing.T) {
+	const account = "ratelimit-test"
+	h := http.Header{}
+	h.Set("X-RateLimit-Remaining", "42")
+	h.Set("X-RateLimit-Reset", "1714568400")
+	updateNestRateLimit(account, parseNestRateLimit(h, time.Now()))
+	if got := testutil.ToFloat64(promNestRateLimitRemaining.WithLabelValues(account)); got != 42 {
+		t.Errorf("nest_ratelimit_remaining = %v, want 42", got)
+	}
+	if got := testutil.ToFloat64(promNestRateLimitReset.WithLabelValues(account)); got != 1714568400 {
+		t.Errorf("nest_ratelimit_reset_timestamp_seconds = %v, want 1714568400", got)
+	}
+
+	updateNestRateLimit(account, parseNestRateLimit(http.Header{}, time.Now()))
+	if promNestRateLimitRemaining.DeleteLabelValues(account) {
+		t.Error("nest_ratelimit_remaining not deleted")
+	}
+	if promNestRateLimitReset.DeleteLabelValues(account) {
+		t.Error("nest_ratelimit_reset_timestamp_seconds not deleted")
+	}
+}
+
+func TestCollectAccountNestHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "unauthorized", "message": "authorization required"}`))
+	}))
+	defer srv.Close()
+
+	p := &nestProvider{baseURL: srv.URL, account: "nest-401", thermostatIDs: []string{"t1"}, clientSecret: "expired"}
+	a := &account{name: "nest-401", providerName: "nest", provider: p}
+	if err := collectAccount(context.Background(), a); err == nil {
+		t.Fatal("collectAccount succeeded on a 401")
+	}
+	if got := testutil.ToFloat64(promThermostatUp.WithLabelValues("nest-401")); got != 0 {
+		t.Errorf("thermostat_up = %v, want 0", got)
+	}
+	if data := currentSnapshot().Accounts["nest-401"]; data == nil || data.Up || len(data.Thermostats) != 0 {
+		t.Errorf("unexpected account data %+v", data)
+	}
+}
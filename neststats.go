@@ -1,12 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"sync"
 	"time"
 
@@ -14,66 +13,41 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type ThermostatData struct {
-	CurrentHumidity    float64 `json:"humidity"`
-	CurrentTemperature float64 `json:"ambient_temperature_c"`
-	TargetTemperature  float64 `json:"target_temperature_c"`
-	HvacState          string  `json:"hvac_state"`
-	StructureID        string  `json:"structure_id"`
-}
-
+// StampedData is what /data serves and the state file holds.
+// ThermostatStamp and ThermostatData repeat the first thermostat of the
+// first account for clients that predate multiple accounts.
 type StampedData struct {
-	ThermostatStamp time.Time      `json:"thermostatStamp"`
-	ThermostatData  ThermostatData `json:"thermostatData"`
-	WeatherStamp    time.Time      `json:"weatherStamp"`
-	WeatherData     OwmWeatherMain `json:"weatherData"`
-}
-
-type OwmWeatherMain struct {
-	Temperature float64 `json:"temp"`
-	Pressure    float64 `json:"pressure"`
-	Humidity    float64 `json:"humidity"`
-}
-
-type OwmResult struct {
-	WeatherMain OwmWeatherMain `json:"main"`
-	// {"coord": {"lon":16.37,"lat":48.21},
-	// 	"weather":[
-	// 		{"id":800,"main":"Clear","description":"clear sky","icon":"01n"}
-	// 	],
-	// 	"base":"stations",
-	// 	"main": {"temp":275.15,"pressure":1018,"humidity":55,"temp_min":275.15,"temp_max":275.15},
-	// 	"visibility": 10000,
-	//  "wind":{"speed":4.6,"deg":240},
-	//  "clouds":{"all":0},
-	//  "dt":1483482600,
-	//  "sys":{"type":1,"id":5934,"message":0.0133,"country":"AT","sunrise":1483425896,"sunset":1483456460},
-	//  "id":2761369,"name":"Vienna","cod":200}
+	ThermostatStamp time.Time               `json:"thermostatStamp"`
+	ThermostatData  Reading                 `json:"thermostatData"`
+	Accounts        map[string]*AccountData `json:"accounts"`
+	WeatherStamp    time.Time               `json:"weatherStamp"`
+	WeatherData     Observation             `json:"weatherData"`
 }
 
-var currentData ThermostatData
-var currentDataTime time.Time
-var currentWeather OwmWeatherMain
+var currentWeather Observation
 var currentWeatherTime time.Time
 var currentDataMutex sync.Mutex
 
+// thermostatLabels identify the device a thermostat metric belongs to.
+var thermostatLabels = []string{"account", "provider", "thermostat"}
+
 var (
-	promHumidity = prometheus.NewGauge(prometheus.GaugeOpts{
+	promHumidity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "env_humidity",
 		Help: "Current humidity.",
-	})
-	promTemperature = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, thermostatLabels)
+	promTemperature = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "env_temperature",
 		Help: "Current temperature.",
-	})
-	promTargetTemperature = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, thermostatLabels)
+	promTargetTemperature = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "target_temperature",
 		Help: "Target temperature.",
-	})
-	promIsHeating = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, thermostatLabels)
+	promIsHeating = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "is_heating",
 		Help: "Flag (0 or 1) indicating if currently heating.",
-	})
+	}, thermostatLabels)
 	promOutsideHumidity = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "outside_humidity",
 		Help: "Current humidity (outside).",
@@ -86,180 +60,207 @@ var (
 		Name: "outside_pressure",
 		Help: "Current pressure (outside).",
 	})
+	promOutsideWindSpeed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "outside_wind_speed",
+		Help: "Current wind speed in m/s (outside).",
+	})
+	promOutsideWindDirection = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "outside_wind_direction",
+		Help: "Current wind direction in degrees (outside).",
+	})
+	promOutsideClouds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "outside_clouds",
+		Help: "Current cloudiness in percent (outside).",
+	})
 )
 
 func init() {
-	prometheus.MustRegister(promHumidity)
-	prometheus.MustRegister(promTemperature)
-	prometheus.MustRegister(promTargetTemperature)
-	prometheus.MustRegister(promIsHeating)
-
-	prometheus.MustRegister(promOutsideHumidity)
-	prometheus.MustRegister(promOutsideTemperature)
-	prometheus.MustRegister(promOutsidePressure)
+	collectGroup("thermostat.humidity", promHumidity)
+	collectGroup("thermostat.temperature", promTemperature)
+	collectGroup("thermostat.target", promTargetTemperature)
+	collectGroup("thermostat.hvac", promIsHeating)
+
+	collectGroup("weather.humidity", promOutsideHumidity)
+	collectGroup("weather.temperature", promOutsideTemperature)
+	collectGroup("weather.pressure", promOutsidePressure)
+	collectGroup("weather.wind", promOutsideWindSpeed, promOutsideWindDirection)
+	collectGroup("weather.clouds", promOutsideClouds)
 }
 
-func headerAdder(auth string) func(req *http.Request) {
-	return func(req *http.Request) {
-		req.Header.Add("Content-Type", "application/json")
-		req.Header.Add("Authorization", auth)
-		req.Header.Add("User-Agent", "curl/7.51.0")
+func setThermostatGauges(ts Reading) {
+	promHumidity.WithLabelValues(ts.Account, ts.Provider, ts.DeviceID).Set(ts.CurrentHumidity)
+	promTemperature.WithLabelValues(ts.Account, ts.Provider, ts.DeviceID).Set(ts.CurrentTemperature)
+	promTargetTemperature.WithLabelValues(ts.Account, ts.Provider, ts.DeviceID).Set(ts.TargetTemperature)
+	var isHeating float64
+	if ts.HvacState == "heating" {
+		isHeating = 1
+	} else {
+		isHeating = 0
 	}
+	promIsHeating.WithLabelValues(ts.Account, ts.Provider, ts.DeviceID).Set(isHeating)
 }
 
-func checkRedirectFunc(headerAdder func(*http.Request)) func(req *http.Request, via []*http.Request) error {
-	return func(req *http.Request, via []*http.Request) error {
-		// re-add Authorization etc.
-		headerAdder(req)
-		// debug(httputil.DumpRequestOut(req, true))
-		return nil
-	}
+// deleteThermostatGauges drops the series of a thermostat that is gone.
+func deleteThermostatGauges(ts Reading) {
+	labelValues := []string{ts.Account, ts.Provider, ts.DeviceID}
+	promHumidity.DeleteLabelValues(labelValues...)
+	promTemperature.DeleteLabelValues(labelValues...)
+	promTargetTemperature.DeleteLabelValues(labelValues...)
+	promIsHeating.DeleteLabelValues(labelValues...)
+	dailyTemperature.remove(labelValues)
+	dailyHumidity.remove(labelValues)
+	removeHistorySeries(sourceThermostat, ts.Account, ts.DeviceID)
 }
 
-func downloadNest(thermostatID string, clientSecret string) (ThermostatData, error) {
-	var data ThermostatData
-
-	auth := "Bearer " + clientSecret
-	myHeaderAdder := headerAdder(auth)
-
-	req, err := http.NewRequest("GET", "https://developer-api.nest.com/devices/thermostats/"+thermostatID, nil)
-
-	client := &http.Client{
-		CheckRedirect: checkRedirectFunc(myHeaderAdder),
-	}
-
-	if err != nil {
-		return data, err
-	}
-	myHeaderAdder(req)
-
-	debug(httputil.DumpRequestOut(req, true))
-
-	resp, err := client.Do(req)
+func collectWeather(ctx context.Context, provider WeatherProvider) error {
+	obs, err := provider.Fetch(ctx)
 	if err != nil {
-		return data, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return data, err
+		log.Printf("error: %v", err)
+		return err
 	}
-
 	if *doDebug {
-		log.Printf("json: %s", body)
+		log.Printf("%v", obs)
 	}
-
-	json.Unmarshal(body, &data)
-	return data, nil
-}
-
-func downloadNestAndStore(thermostatID string, clientSecret string) {
-	ts, err := downloadNest(thermostatID, clientSecret)
-	if err != nil {
-		log.Printf("error: %v", err)
-	} else {
-		if *doDebug {
-			log.Printf("%v", ts)
-		}
-		currentDataMutex.Lock()
-		currentData = ts
-		currentDataTime = time.Now()
+	now := time.Now()
+	currentDataMutex.Lock()
+	if emptyWeather(obs) {
+		// Keep the previous observation and its time, so the data goes
+		// stale, and log no sample.
+		rejectEmptyWeather(obs, currentWeather)
 		currentDataMutex.Unlock()
-		promHumidity.Set(ts.CurrentHumidity)
-		promTemperature.Set(ts.CurrentTemperature)
-		promTargetTemperature.Set(ts.TargetTemperature)
-		var isHeating float64
-		if ts.HvacState == "heating" {
-			isHeating = 1
-		} else {
-			isHeating = 0
-		}
-		promIsHeating.Set(isHeating)
+		return nil
 	}
+	obs, _ = validateWeather(calibrateObservation(obs), currentWeather)
+	currentWeather = obs
+	currentWeatherTime = now
+	currentDataMutex.Unlock()
+	setWeatherGauges(obs)
+	saveState()
+	recordSample(weatherSample(obs, now))
+	return nil
 }
 
-func downloadWeatherAndStore(apiKey string, cityID string) {
-	var result OwmResult
-	resp, err := http.Get("http://api.openweathermap.org/data/2.5/weather?units=metric&id=" + cityID + "&appid=" + apiKey)
-
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("error: %v", err)
-		return
+func setWeatherGauges(obs Observation) {
+	promOutsideHumidity.Set(obs.Humidity)
+	promOutsideTemperature.Set(obs.Temperature)
+	promOutsidePressure.Set(obs.Pressure)
+	if obs.WindSpeed != nil {
+		promOutsideWindSpeed.Set(*obs.WindSpeed)
 	}
-
-	if *doDebug {
-		log.Printf("json: %s", body)
+	if obs.WindDirection != nil {
+		promOutsideWindDirection.Set(*obs.WindDirection)
 	}
-
-	json.Unmarshal(body, &result)
-
-	if err != nil {
-		log.Printf("error: %v", err)
-	} else {
-		if *doDebug {
-			log.Printf("%v", result)
-		}
-		currentDataMutex.Lock()
-		currentWeather = result.WeatherMain
-		currentWeatherTime = time.Now()
-		currentDataMutex.Unlock()
-		promOutsideHumidity.Set(result.WeatherMain.Humidity)
-		promOutsideTemperature.Set(result.WeatherMain.Temperature)
-		promOutsidePressure.Set(result.WeatherMain.Pressure)
+	if obs.Clouds != nil {
+		promOutsideClouds.Set(*obs.Clouds)
 	}
+	setPressureGauges(obs)
 }
 
+var thermostatProviderName = flag.String("thermostat-provider", "nest", "thermostat provider to poll (nest, ecobee, fake), unless -config is given")
 var listenOn = flag.String("listen-address", "127.0.0.1:9092", "The address to listen on for HTTP requests.")
 var clientSecret = flag.String("client-secret", "", "")
-var thermostatID = flag.String("thermostat-id", "", "")
+var thermostatID = flag.String("thermostat-id", "", "comma-separated Nest thermostat IDs (with -discover-thermostats, only poll these)")
+var discoverThermostats = flag.Bool("discover-thermostats", false, "poll all Nest thermostats of the account with a single request")
 var doDebug = flag.Bool("debug", false, "emit debug info")
+var weatherProviderName = flag.String("weather-provider", "owm", "weather provider to poll (owm, none)")
 var owmAPIKey = flag.String("owm-apikey", "", "openweathermap API Key")
 var owmCityID = flag.String("owm-city-id", "2761369", "openweathermap.org cityID") // cityID defaults to Vienna, AT
 
 func main() {
 	flag.Parse()
-	if *clientSecret == "" || *thermostatID == "" {
-		log.Fatal("clientSecret or thermostatID missing\n")
+	if err := setupCollectGroups(); err != nil {
+		log.Fatal(err)
+	}
+	registerTimingMetrics()
+	registerPressureMetrics()
+	registerCalibrationMetrics()
+	setupAlerts()
+	initHistory()
+	if err := setupAccounts(); err != nil {
+		log.Fatal(err)
+	}
+	if *enableWriteAPI && *writeAPIToken == "" {
+		log.Fatal("-enable-write-api requires -write-api-token")
 	}
 	log.Printf("starting, will listen on %v", *listenOn)
+	restoreState()
+	if err := openSQLite(); err != nil {
+		log.Printf("error: sqlite logging disabled: %v", err)
+	}
+	if err := startDailyAggregates(); err != nil {
+		log.Fatal(err)
+	}
+	if err := openCSVLog(); err != nil {
+		log.Fatal(err)
+	}
 
-	nestTicker := time.NewTicker(time.Second * 30)
-	go func() {
-		downloadNestAndStore(*thermostatID, *clientSecret)
-		for t := range nestTicker.C {
-			log.Printf("nestTicker tick at %v", t)
-			downloadNestAndStore(*thermostatID, *clientSecret)
-		}
-	}()
+	for _, a := range accounts {
+		a := a
+		go poll("thermostatTicker "+a.name, newPollTracker(sourceThermostat, a.name), time.Second*30, a.pollNow, func(ctx context.Context) error {
+			return collectAccount(ctx, a)
+		})
+	}
 
-	weatherTicker := time.NewTicker(time.Minute * 10)
-	go func() {
-		if *owmAPIKey == "" {
-			log.Printf("no OWM Api Key, not fetching weather data")
-			return
-		}
-		downloadWeatherAndStore(*owmAPIKey, *owmCityID)
-		for t := range weatherTicker.C {
-			log.Printf("weatherTicker tick at %v", t)
-			downloadWeatherAndStore(*owmAPIKey, *owmCityID)
+	var weatherProvider WeatherProvider
+	var err error
+	if !collectPrefixEnabled("weather") {
+		log.Printf("no weather metrics exported, not fetching weather data")
+	} else if *weatherProviderName == "none" {
+		log.Printf("no weather provider, not fetching weather data")
+	} else if *weatherProviderName == "owm" && *owmAPIKey == "" {
+		log.Printf("no OWM Api Key, not fetching weather data")
+	} else {
+		weatherProvider, err = newWeatherProvider(*weatherProviderName)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
+	}
+
+	if weatherProvider != nil {
+		runWeatherBackfill(weatherProvider)
+		go poll("weatherTicker", newPollTracker(sourceWeather, ""), time.Minute*10, nil, func(ctx context.Context) error {
+			return collectWeather(ctx, weatherProvider)
+		})
+	}
+
+	go watchdog(time.Minute)
 
 	http.HandleFunc("/data", httpDataHandler)
+	http.HandleFunc("/healthz", httpHealthzHandler)
+	http.HandleFunc("/query", httpQueryHandler)
+	http.HandleFunc("/history", httpHistoryHandler)
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/debug/config", httpDebugConfigHandler)
+	if *enableWriteAPI {
+		http.HandleFunc("/target", requireWriteAuth(httpTargetHandler))
+		http.HandleFunc("/away", requireWriteAuth(httpAwayHandler))
+	}
 	log.Fatal(http.ListenAndServe(*listenOn, nil))
 }
 
-func httpDataHandler(w http.ResponseWriter, req *http.Request) {
+func currentSnapshot() StampedData {
 	var data StampedData
+	data.Accounts = map[string]*AccountData{}
 	currentDataMutex.Lock()
-	data.ThermostatData = currentData
-	data.ThermostatStamp = currentDataTime
+	for name, ad := range accountData {
+		c := *ad
+		c.Thermostats = append([]Reading(nil), ad.Thermostats...)
+		data.Accounts[name] = &c
+	}
+	if len(accounts) > 0 {
+		if first, ok := data.Accounts[accounts[0].name]; ok && len(first.Thermostats) > 0 {
+			data.ThermostatData = first.Thermostats[0]
+			data.ThermostatStamp = first.Stamp
+		}
+	}
 	data.WeatherData = currentWeather
 	data.WeatherStamp = currentWeatherTime
 	currentDataMutex.Unlock()
+	return data
+}
+
+func httpDataHandler(w http.ResponseWriter, req *http.Request) {
+	data := currentSnapshot()
 
 	b, _ := json.Marshal(data)
 	w.Write(b)
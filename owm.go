@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type OwmWeatherMain struct {
+	Temperature *float64 `json:"temp"`
+	Pressure    *float64 `json:"pressure"`
+	Humidity    *float64 `json:"humidity"`
+}
+
+type OwmResult struct {
+	WeatherMain OwmWeatherMain `json:"main"`
+	Wind        *struct {
+		Speed     *float64 `json:"speed"`
+		Direction *float64 `json:"deg"`
+	} `json:"wind"`
+	Clouds *struct {
+		All *float64 `json:"all"`
+	} `json:"clouds"`
+	Timestamp int64 `json:"dt"`
+	// {"coord": {"lon":16.37,"lat":48.21},
+	// 	"weather":[
+	// 		{"id":800,"main":"Clear","description":"clear sky","icon":"01n"}
+	// 	],
+	// 	"base":"stations",
+	// 	"main": {"temp":275.15,"pressure":1018,"humidity":55,"temp_min":275.15,"temp_max":275.15},
+	// 	"visibility": 10000,
+	//  "wind":{"speed":4.6,"deg":240},
+	//  "clouds":{"all":0},
+	//  "dt":1483482600,
+	//  "sys":{"type":1,"id":5934,"message":0.0133,"country":"AT","sunrise":1483425896,"sunset":1483456460},
+	//  "id":2761369,"name":"Vienna","cod":200}
+}
+
+const owmBaseURL = "http://api.openweathermap.org/data/2.5"
+const owmHistoryURL = "http://history.openweathermap.org/data/2.5"
+
+// owmProvider fetches the current weather for a city from openweathermap.org.
+type owmProvider struct {
+	baseURL    string
+	historyURL string
+	apiKey     string
+	cityID     string
+}
+
+func init() {
+	registerWeatherProvider("owm", func() (WeatherProvider, error) {
+		if *owmAPIKey == "" {
+			return nil, errors.New("owm: -owm-apikey missing")
+		}
+		if *owmCityID == "" {
+			return nil, errors.New("owm: -owm-city-id missing")
+		}
+		return &owmProvider{baseURL: owmBaseURL, historyURL: owmHistoryURL, apiKey: *owmAPIKey, cityID: *owmCityID}, nil
+	})
+}
+
+func (p *owmProvider) Fetch(ctx context.Context) (Observation, error) {
+	body, err := p.get(ctx, p.baseURL+"/weather?units=metric&id="+url.QueryEscape(p.cityID)+"&appid="+url.QueryEscape(p.apiKey))
+	if err != nil {
+		return Observation{}, err
+	}
+	return parseOwmWeather(body)
+}
+
+// Backfill fetches hourly observations from the history API.
+func (p *owmProvider) Backfill(ctx context.Context, from, to time.Time) ([]Observation, error) {
+	u := fmt.Sprintf("%s/history/city?type=hour&units=metric&id=%s&start=%d&end=%d&appid=%s",
+		p.historyURL, url.QueryEscape(p.cityID), from.Unix(), to.Unix(), url.QueryEscape(p.apiKey))
+	body, err := p.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return parseOwmHistory(body)
+}
+
+func (p *owmProvider) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = traceRequest(req, "owm")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if *doDebug {
+		log.Printf("json: %s", body)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("owm: unexpected status %s: %s", resp.Status, body)
+	}
+	return body, nil
+}
+
+// parseOwmWeather converts a /weather response body into an Observation.
+func parseOwmWeather(body []byte) (Observation, error) {
+	var result OwmResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return Observation{}, err
+	}
+	return result.observation(), nil
+}
+
+// parseOwmHistory converts a /history/city response body, whose list
+// entries are shaped like /weather results, into Observations.
+func parseOwmHistory(body []byte) ([]Observation, error) {
+	var result struct {
+		List []OwmResult `json:"list"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	var observations []Observation
+	for _, r := range result.List {
+		observations = append(observations, r.observation())
+	}
+	return observations, nil
+}
+
+func (result OwmResult) observation() Observation {
+	var obs Observation
+	obs.Temperature = payloadValue("outside_temperature", result.WeatherMain.Temperature, &obs.missing)
+	obs.Pressure = payloadValue("outside_pressure", result.WeatherMain.Pressure, &obs.missing)
+	obs.Humidity = payloadValue("outside_humidity", result.WeatherMain.Humidity, &obs.missing)
+	if result.Wind != nil {
+		obs.WindSpeed = result.Wind.Speed
+		obs.WindDirection = result.Wind.Direction
+	}
+	if result.Clouds != nil {
+		obs.Clouds = result.Clouds.All
+	}
+	if result.Timestamp != 0 {
+		obs.ObservedAt = time.Unix(result.Timestamp, 0)
+	}
+	return obs
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func floatPtrEqual(p *float64, want float64) bool {
+	return p != nil && *p == want
+}
+
+func TestParseOwmWeather(t *testing.T) {
+	obs, err := parseOwmWeather(readTestdata(t, "owm-weather.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obs.Temperature != 275.15 || obs.Pressure != 1018 || obs.Humidity != 55 {
+		t.Errorf("got %+v", obs)
+	}
+	if !floatPtrEqual(obs.WindSpeed, 4.6) || !floatPtrEqual(obs.WindDirection, 240) || !floatPtrEqual(obs.Clouds, 0) {
+		t.Errorf("wind/clouds: got %v %v %v", obs.WindSpeed, obs.WindDirection, obs.Clouds)
+	}
+	if !obs.ObservedAt.Equal(time.Unix(1483482600, 0)) {
+		t.Errorf("ObservedAt = %v", obs.ObservedAt)
+	}
+	if len(obs.missing) != 0 {
+		t.Errorf("missing = %v", obs.missing)
+	}
+}
+
+func TestParseOwmWeatherWithoutOptionalFields(t *testing.T) {
+	obs, err := parseOwmWeather([]byte(`{"main":{"temp":3.5,"pressure":1012}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obs.WindSpeed != nil || obs.WindDirection != nil || obs.Clouds != nil {
+		t.Errorf("wind/clouds: got %v %v %v, want nil", obs.WindSpeed, obs.WindDirection, obs.Clouds)
+	}
+	if !obs.ObservedAt.IsZero() {
+		t.Errorf("ObservedAt = %v, want zero", obs.ObservedAt)
+	}
+	if len(obs.missing) != 1 || obs.missing[0] != "outside_humidity" {
+		t.Errorf("missing = %v, want [outside_humidity]", obs.missing)
+	}
+}
+
+func TestParseOwmHistory(t *testing.T) {
+	observations, err := parseOwmHistory(readTestdata(t, "owm-history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(observations) != 2 {
+		t.Fatalf("got %d observations, want 2", len(observations))
+	}
+	first, second := observations[0], observations[1]
+	if first.Temperature != 1.9 || first.Pressure != 1019 || first.Humidity != 60 {
+		t.Errorf("first: got %+v", first)
+	}
+	if !floatPtrEqual(first.WindSpeed, 3.1) || !floatPtrEqual(first.WindDirection, 250) || !floatPtrEqual(first.Clouds, 20) {
+		t.Errorf("first wind/clouds: got %v %v %v", first.WindSpeed, first.WindDirection, first.Clouds)
+	}
+	if !first.ObservedAt.Equal(time.Unix(1483473600, 0)) || !second.ObservedAt.Equal(time.Unix(1483477200, 0)) {
+		t.Errorf("ObservedAt = %v, %v", first.ObservedAt, second.ObservedAt)
+	}
+	if second.WindSpeed != nil || second.Clouds != nil {
+		t.Errorf("second wind/clouds: got %v %v, want nil", second.WindSpeed, second.Clouds)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var watchdogIntervals = flag.Int("watchdog-intervals", 5, "report a source as stalled in /healthz after this many poll intervals without a fetch attempt")
+
+var (
+	promMissedPolls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "missed_polls_total",
+		Help: "Polls that failed, or were skipped because the previous one was still running.",
+	}, []string{"source", "account"})
+	promDowntime = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "collection_downtime_seconds_total",
+		Help: "Time spent between a failed poll and the next successful one.",
+	}, []string{"source", "account"})
+	promPollerPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poller_panics_total",
+		Help: "Polls that panicked and were recovered.",
+	}, []string{"source"})
+	promPollerStalled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "poller_stalled",
+		Help: "Flag (0 or 1) indicating if a source has not attempted a fetch for -watchdog-intervals poll intervals.",
+	}, []string{"source", "account"})
+)
+
+func init() {
+	prometheus.MustRegister(promMissedPolls)
+	prometheus.MustRegister(promDowntime)
+	prometheus.MustRegister(promPollerPanics)
+	prometheus.MustRegister(promPollerStalled)
+}
+
+// pollTracker does the missed poll and downtime accounting of one source.
+// All methods take the current time so the accounting can be driven by a
+// fake clock. Downtime starts with the first failure seen by this process,
+// so time spent before a restart is never counted.
+type pollTracker struct {
+	source  string
+	account string
+
+	mu          sync.Mutex
+	running     bool
+	failing     bool
+	mark        time.Time // downtime has been counted up to here
+	interval    time.Duration
+	lastAttempt time.Time
+	stalled     bool
+
+	missed   prometheus.Counter
+	downtime prometheus.Counter
+}
+
+// pollTrackers lists all trackers for the watchdog.
+var (
+	pollTrackers      []*pollTracker
+	pollTrackersMutex sync.Mutex
+)
+
+func newPollTracker(source, account string) *pollTracker {
+	t := &pollTracker{
+		source:      source,
+		account:     account,
+		lastAttempt: time.Now(),
+		missed:      promMissedPolls.WithLabelValues(source, account),
+		downtime:    promDowntime.WithLabelValues(source, account),
+	}
+	promPollerStalled.WithLabelValues(source, account).Set(0)
+	pollTrackersMutex.Lock()
+	pollTrackers = append(pollTrackers, t)
+	pollTrackersMutex.Unlock()
+	return t
+}
+
+func (t *pollTracker) String() string {
+	if t.account == "" {
+		return t.source
+	}
+	return t.source + "/" + t.account
+}
+
+// accrue counts the downtime up to now. Must be called with t.mu held.
+func (t *pollTracker) accrue(now time.Time) {
+	if t.failing && now.After(t.mark) {
+		t.downtime.Add(now.Sub(t.mark).Seconds())
+		t.mark = now
+	}
+}
+
+// tick is called on every interval, whether or not a poll is attempted.
+func (t *pollTracker) tick(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.accrue(now)
+}
+
+// begin reports whether a poll may start. If the previous one is still
+// running, the tick counts as missed.
+func (t *pollTracker) begin(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running {
+		t.missed.Inc()
+		return false
+	}
+	t.running = true
+	t.lastAttempt = now
+	return true
+}
+
+// isRunning reports whether a poll is in progress.
+func (t *pollTracker) isRunning() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.running
+}
+
+// finish records the outcome of a poll that ended at now.
+func (t *pollTracker) finish(now time.Time, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running = false
+	t.accrue(now)
+	if err != nil {
+		t.missed.Inc()
+		if !t.failing {
+			t.failing = true
+			t.mark = now
+		}
+		return
+	}
+	t.failing = false
+}
+
+// checkStalled updates the stalled state: a source is stalled once it has
+// not attempted a fetch for -watchdog-intervals intervals, because the
+// fetch hangs or the poll goroutine is gone. It reports whether the state
+// changed.
+func (t *pollTracker) checkStalled(now time.Time) (stalled, changed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.interval == 0 {
+		return t.stalled, false
+	}
+	stalled = now.Sub(t.lastAttempt) > time.Duration(*watchdogIntervals)*t.interval
+	changed = stalled != t.stalled
+	t.stalled = stalled
+	return stalled, changed
+}
+
+// watchdog periodically checks all sources for stalls, logging changes and
+// updating the poller_stalled gauge. It also evaluates the alerts, so stale
+// data is noticed even if no poll ever finishes.
+func watchdog(every time.Duration) {
+	for now := range time.NewTicker(every).C {
+		checkWatchdog(now)
+		safeEvaluateAlerts(now)
+	}
+}
+
+func checkWatchdog(now time.Time) {
+	pollTrackersMutex.Lock()
+	trackers := append([]*pollTracker(nil), pollTrackers...)
+	pollTrackersMutex.Unlock()
+	for _, t := range trackers {
+		stalled, changed := t.checkStalled(now)
+		if !changed {
+			continue
+		}
+		if stalled {
+			log.Printf("error: watchdog: %s has not attempted a fetch since %v", t, t.lastAttemptTime())
+			promPollerStalled.WithLabelValues(t.source, t.account).Set(1)
+		} else {
+			log.Printf("watchdog: %s is polling again", t)
+			promPollerStalled.WithLabelValues(t.source, t.account).Set(0)
+		}
+	}
+}
+
+func (t *pollTracker) lastAttemptTime() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastAttempt
+}
+
+// httpHealthzHandler answers 200 unless the watchdog found a stalled
+// source, in which case it answers 503 listing them.
+func httpHealthzHandler(w http.ResponseWriter, req *http.Request) {
+	pollTrackersMutex.Lock()
+	var stalled []string
+	for _, t := range pollTrackers {
+		t.mu.Lock()
+		if t.stalled {
+			stalled = append(stalled, t.String())
+		}
+		t.mu.Unlock()
+	}
+	pollTrackersMutex.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(stalled) > 0 {
+		sort.Strings(stalled)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "stalled: %s\n", strings.Join(stalled, ", "))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// recoverPoll turns a panic in fetch into an error, logging the stack.
+func recoverPoll(name, source string, fetch func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("error: %s: panic: %v\n%s", name, r, buf)
+			promPollerPanics.WithLabelValues(source).Inc()
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fetch()
+}
+
+// poll calls fetch right away, then every interval and whenever something
+// arrives on now. Each fetch gets a context that expires after one
+// interval. Ticks arriving while a fetch is still running are skipped, and
+// a panicking fetch counts as a failed poll. Requests on now are dropped
+// while a fetch runs, without counting as missed.
+func poll(name string, tracker *pollTracker, interval time.Duration, now <-chan struct{}, fetch func(ctx context.Context) error) {
+	tracker.mu.Lock()
+	tracker.interval = interval
+	tracker.mu.Unlock()
+	run := func() {
+		if !tracker.begin(time.Now()) {
+			log.Printf("%s: previous poll still running, skipping", name)
+			return
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			defer cancel()
+			err := recoverPoll(name, tracker.source, func() error { return fetch(ctx) })
+			tracker.finish(time.Now(), err)
+			safeEvaluateAlerts(time.Now())
+		}()
+	}
+	run()
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case t := <-ticker.C:
+			log.Printf("%s tick at %v", name, t)
+			tracker.tick(t)
+			run()
+		case <-now:
+			if tracker.isRunning() {
+				log.Printf("%s: poll requested while one is running, skipping", name)
+				continue
+			}
+			run()
+		}
+	}
+}
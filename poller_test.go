@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var errPoll = errors.New("poll failed")
+
+func TestPollTrackerMissedPolls(t *testing.T) {
+	tracker := newPollTracker(sourceThermostat, "missed-test")
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	if !tracker.begin(at(0)) {
+		t.Fatal("first poll not started")
+	}
+	// Two ticks while the first poll hangs are skipped.
+	tracker.tick(at(30))
+	if tracker.begin(at(30)) {
+		t.Error("poll started while the previous one was running")
+	}
+	tracker.tick(at(60))
+	tracker.begin(at(60))
+	if got := testutil.ToFloat64(tracker.missed); got != 2 {
+		t.Errorf("missed = %v after two skipped ticks, want 2", got)
+	}
+
+	tracker.finish(at(70), nil)
+	if got := testutil.ToFloat64(tracker.missed); got != 2 {
+		t.Errorf("missed = %v after a successful poll, want 2", got)
+	}
+
+	tracker.tick(at(90))
+	tracker.begin(at(90))
+	tracker.finish(at(95), errPoll)
+	if got := testutil.ToFloat64(tracker.missed); got != 3 {
+		t.Errorf("missed = %v after a failed poll, want 3", got)
+	}
+}
+
+func TestPollTrackerDowntime(t *testing.T) {
+	tracker := newPollTracker(sourceWeather, "downtime-test")
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	poll := func(begin, end int, err error) {
+		tracker.tick(at(begin))
+		if !tracker.begin(at(begin)) {
+			t.Fatalf("poll at %d not started", begin)
+		}
+		tracker.finish(at(end), err)
+	}
+	downtime := func() float64 { return testutil.ToFloat64(tracker.downtime) }
+
+	poll(0, 5, nil)
+	poll(600, 605, errPoll) // down from 605
+	if got := downtime(); got != 0 {
+		t.Errorf("downtime = %v right after the first failure, want 0", got)
+	}
+	tracker.tick(at(1205))
+	if got := downtime(); got != 600 {
+		t.Errorf("downtime = %v one tick into the failure, want 600", got)
+	}
+	poll(1800, 1805, errPoll)
+	if got := downtime(); got != 1200 {
+		t.Errorf("downtime = %v after the second failure, want 1200", got)
+	}
+	poll(2400, 2410, nil) // up again at 2410
+	if got := downtime(); got != 1805 {
+		t.Errorf("downtime = %v after recovering, want 1805", got)
+	}
+	tracker.tick(at(3000))
+	poll(3000, 3005, nil)
+	if got := downtime(); got != 1805 {
+		t.Errorf("downtime = %v while up, want 1805", got)
+	}
+}
+
+func TestPollTrackerNoDowntimeBeforeFirstFailure(t *testing.T) {
+	tracker := newPollTracker(sourceThermostat, "startup-test")
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// A poll that hangs from startup is missed, but there was no failure
+	// to count downtime from.
+	tracker.begin(start)
+	for i := 1; i <= 10; i++ {
+		now := start.Add(time.Duration(i) * 30 * time.Second)
+		tracker.tick(now)
+		tracker.begin(now)
+	}
+	if got := testutil.ToFloat64(tracker.downtime); got != 0 {
+		t.Errorf("downtime = %v before any failure, want 0", got)
+	}
+	if got := testutil.ToFloat64(tracker.missed); got != 10 {
+		t.Errorf("missed = %v, want 10", got)
+	}
+}
+
+func TestPollRequestPoll(t *testing.T) {
+	tracker := newPollTracker(sourceThermostat, "poll-now-test")
+	a := &account{name: "poll-now-test", pollNow: make(chan struct{}, 1)}
+	fetched := make(chan struct{}, 2)
+	go poll("poll-now-test", tracker, time.Hour, a.pollNow, func(ctx context.Context) error {
+		fetched <- struct{}{}
+		return nil
+	})
+
+	<-fetched
+	for tracker.isRunning() {
+		time.Sleep(time.Millisecond)
+	}
+	a.requestPoll()
+	select {
+	case <-fetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requested poll did not run")
+	}
+	if got := testutil.ToFloat64(tracker.missed); got != 0 {
+		t.Errorf("missed = %v, want 0", got)
+	}
+}
+
+func TestPollFetchDeadline(t *testing.T) {
+	tracker := newPollTracker(sourceWeather, "deadline-test")
+	deadlines := make(chan time.Time, 1)
+	start := time.Now()
+	go poll("deadline-test", tracker, time.Hour, nil, func(ctx context.Context) error {
+		deadline, _ := ctx.Deadline()
+		deadlines <- deadline
+		return nil
+	})
+	deadline := <-deadlines
+	if deadline.Before(start.Add(time.Hour)) || deadline.After(time.Now().Add(time.Hour)) {
+		t.Errorf("deadline %v, want one interval after %v", deadline, start)
+	}
+}
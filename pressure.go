@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var stationElevation = flag.Float64("station-elevation-m", 0, "elevation of the weather station in meters; if set, sea-level corrected pressure is exported")
+
+var promOutsidePressureSeaLevel = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "outside_pressure_sea_level_corrected",
+	Help: "Current pressure (outside), reduced to sea level using -station-elevation-m.",
+})
+
+// seaLevelCorrection is whether -station-elevation-m was given.
+var seaLevelCorrection bool
+
+// registerPressureMetrics registers the sea-level gauge if the station
+// elevation was given. Call it after flag.Parse.
+func registerPressureMetrics() {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "station-elevation-m" {
+			seaLevelCorrection = true
+		}
+	})
+	if seaLevelCorrection && collectEnabled("weather.pressure") {
+		prometheus.MustRegister(promOutsidePressureSeaLevel)
+	}
+}
+
+// seaLevelPressure reduces the station pressure (hPa) measured at elevation
+// (m) to sea level with the hypsometric formula, using the outdoor
+// temperature (°C). Without a temperature the standard atmosphere is
+// assumed, i.e. 15 °C at sea level falling by 6.5 °C per km.
+func seaLevelPressure(stationPressure, elevation float64, temperature *float64) float64 {
+	const lapseRate = 0.0065 // K/m
+	t := 15 - lapseRate*elevation
+	if temperature != nil {
+		t = *temperature
+	}
+	return stationPressure * math.Pow(1-lapseRate*elevation/(t+lapseRate*elevation+273.15), -5.257)
+}
+
+func setPressureGauges(obs Observation) {
+	if !seaLevelCorrection {
+		return
+	}
+	temperature := &obs.Temperature
+	if isMissing("outside_temperature", obs.missing) {
+		temperature = nil
+	}
+	promOutsidePressureSeaLevel.Set(seaLevelPressure(obs.Pressure, *stationElevation, temperature))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Pressures of the ICAO standard atmosphere (ISO 2533) at the given
+// elevations, all of which reduce to 1013.25 hPa at sea level.
+var isaPressure = []struct {
+	elevation, pressure, temperature float64
+}{
+	{0, 1013.25, 15},
+	{500, 954.61, 11.75},
+	{1000, 898.76, 8.5},
+	{2000, 794.95, 2},
+	{3000, 701.12, -4.5},
+}
+
+func TestSeaLevelPressureStandardAtmosphere(t *testing.T) {
+	for _, tt := range isaPressure {
+		if got := seaLevelPressure(tt.pressure, tt.elevation, nil); math.Abs(got-1013.25) > 0.2 {
+			t.Errorf("%v m, no temperature: got %.2f hPa, want 1013.25", tt.elevation, got)
+		}
+		temperature := tt.temperature
+		if got := seaLevelPressure(tt.pressure, tt.elevation, &temperature); math.Abs(got-1013.25) > 0.2 {
+			t.Errorf("%v m, %v °C: got %.2f hPa, want 1013.25", tt.elevation, tt.temperature, got)
+		}
+	}
+}
+
+func TestSeaLevelPressureTemperature(t *testing.T) {
+	// Warm air is less dense, so the same station pressure means less
+	// pressure at sea level than in cold air.
+	warm, cold := 25.0, -10.0
+	pWarm := seaLevelPressure(898.76, 1000, &warm)
+	pCold := seaLevelPressure(898.76, 1000, &cold)
+	if !(pWarm < 1013.25 && pCold > 1013.25) {
+		t.Errorf("got %.2f hPa at 25 °C and %.2f hPa at -10 °C", pWarm, pCold)
+	}
+	// p·exp(g·h / (R·Tm)) with the mean column temperature Tm = 28.25 °C.
+	if math.Abs(pWarm-1006.63) > 0.1 {
+		t.Errorf("got %.2f hPa at 25 °C, want 1006.63", pWarm)
+	}
+}
+
+func TestSetPressureGauges(t *testing.T) {
+	savedElevation, savedCorrection := *stationElevation, seaLevelCorrection
+	*stationElevation, seaLevelCorrection = 1000, true
+	defer func() { *stationElevation, seaLevelCorrection = savedElevation, savedCorrection }()
+
+	// Without an observed temperature the standard atmosphere is used;
+	// using the (zero) temperature field would give 1017.0 hPa.
+	setPressureGauges(Observation{Pressure: 898.76, missing: []string{"outside_temperature"}})
+	if got := testutil.ToFloat64(promOutsidePressureSeaLevel); math.Abs(got-1013.25) > 0.2 {
+		t.Errorf("no temperature: got %.2f hPa, want 1013.25", got)
+	}
+	setPressureGauges(Observation{Pressure: 898.76, Temperature: 25})
+	if got := testutil.ToFloat64(promOutsidePressureSeaLevel); math.Abs(got-1006.63) > 0.1 {
+		t.Errorf("25 °C: got %.2f hPa, want 1006.63", got)
+	}
+}
+
+func TestValidateWeatherAtAltitude(t *testing.T) {
+	savedElevation, savedCorrection := *stationElevation, seaLevelCorrection
+	*stationElevation, seaLevelCorrection = 2000, true
+	defer func() { *stationElevation, seaLevelCorrection = savedElevation, savedCorrection }()
+
+	// The 800 hPa minimum scales to about 628 hPa at 2000 m.
+	obs, _ := validateWeather(Observation{Temperature: 2, Humidity: 60, Pressure: 794.95}, Observation{Pressure: 800})
+	if obs.Pressure != 794.95 {
+		t.Errorf("station pressure at 2000 m rejected, got %v", obs.Pressure)
+	}
+	obs, _ = validateWeather(Observation{Temperature: 2, Humidity: 60, Pressure: 600}, Observation{Pressure: 800})
+	if obs.Pressure != 800 {
+		t.Errorf("implausible station pressure at 2000 m accepted, got %v", obs.Pressure)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import "time"
+
+// Sample is a single successful poll result in the flat shape used by the
+// on-disk logs. Fields that don't apply to a source are nil.
+type Sample struct {
+	Time              time.Time `json:"timestamp"`
+	Source            string    `json:"source"`
+	Account           string    `json:"account,omitempty"`
+	Provider          string    `json:"provider,omitempty"`
+	Thermostat        string    `json:"thermostat,omitempty"`
+	Temperature       *float64  `json:"temperature,omitempty"`
+	Humidity          *float64  `json:"humidity,omitempty"`
+	TargetTemperature *float64  `json:"target_temperature,omitempty"`
+	HvacState         *string   `json:"hvac_state,omitempty"`
+	Pressure          *float64  `json:"pressure,omitempty"`
+	Backfilled        bool      `json:"backfilled,omitempty"`
+}
+
+const (
+	sourceThermostat = "thermostat"
+	sourceWeather    = "weather"
+)
+
+func thermostatSample(ts Reading, t time.Time) Sample {
+	return Sample{
+		Time:              t,
+		Source:            sourceThermostat,
+		Account:           ts.Account,
+		Provider:          ts.Provider,
+		Thermostat:        ts.DeviceID,
+		Temperature:       &ts.CurrentTemperature,
+		Humidity:          &ts.CurrentHumidity,
+		TargetTemperature: &ts.TargetTemperature,
+		HvacState:         &ts.HvacState,
+	}
+}
+
+func weatherSample(obs Observation, t time.Time) Sample {
+	return Sample{
+		Time:        t,
+		Source:      sourceWeather,
+		Temperature: &obs.Temperature,
+		Humidity:    &obs.Humidity,
+		Pressure:    &obs.Pressure,
+	}
+}
+
+// recordSample hands s to all enabled sample logs.
+func recordSample(s Sample) {
+	enqueueSQLiteSample(s)
+	enqueueCSVSample(s)
+	updateDailyAggregates(s)
+	addHistorySample(s)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var sqlitePath = flag.String("sqlite-path", "", "SQLite database to log every sample to")
+var sqliteRetention = flag.Duration("sqlite-retention", 0, "delete samples older than this from the SQLite database (0 keeps everything)")
+
+// sqliteMigrations are applied in order, each in its own transaction; the
+// schema_version table records how many have been applied. Only ever
+// append to this list.
+var sqliteMigrations = [][]string{
+	{`CREATE TABLE samples (
+		timestamp INTEGER NOT NULL,
+		source TEXT NOT NULL,
+		temperature REAL,
+		humidity REAL,
+		target_temperature REAL,
+		hvac_state TEXT,
+		pressure REAL,
+		PRIMARY KEY (timestamp, source)
+	)`},
+	// Multiple accounts and thermostats: these become part of the key,
+	// which SQLite can only change by rebuilding the table.
+	{`CREATE TABLE samples_v2 (
+		timestamp INTEGER NOT NULL,
+		source TEXT NOT NULL,
+		account TEXT NOT NULL DEFAULT '',
+		provider TEXT NOT NULL DEFAULT '',
+		thermostat TEXT NOT NULL DEFAULT '',
+		temperature REAL,
+		humidity REAL,
+		target_temperature REAL,
+		hvac_state TEXT,
+		pressure REAL,
+		PRIMARY KEY (timestamp, source, account, thermostat)
+	)`,
+		`INSERT INTO samples_v2 (timestamp, source, temperature, humidity, target_temperature, hvac_state, pressure)
+		SELECT timestamp, source, temperature, humidity, target_temperature, hvac_state, pressure FROM samples`,
+		`DROP TABLE samples`,
+		`ALTER TABLE samples_v2 RENAME TO samples`,
+	},
+}
+
+const sqlitePruneInterval = time.Hour
+
+var sqliteDB *sql.DB
+
+// sqliteQueue decouples the polling goroutines from database writes.
+var sqliteQueue = make(chan Sample, 100)
+
+// openSQLite opens -sqlite-path, migrates its schema and starts the writer.
+// It does nothing if no path is configured.
+func openSQLite() error {
+	if *sqlitePath == "" {
+		return nil
+	}
+	db, err := sql.Open("sqlite", *sqlitePath)
+	if err != nil {
+		return err
+	}
+	// modernc.org/sqlite does not like concurrent writers on one file.
+	db.SetMaxOpenConns(1)
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return err
+	}
+	sqliteDB = db
+	go sqliteWriter(db)
+	return nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	err := db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err := db.Exec(`INSERT INTO schema_version (version) VALUES (0)`); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("sqlite: schema version %d is newer than supported version %d", version, len(sqliteMigrations))
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range sqliteMigrations[i] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("sqlite: migration %d: %v", i+1, err)
+			}
+		}
+		if _, err := tx.Exec(`UPDATE schema_version SET version = ?`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("sqlite: migrated schema to version %d", i+1)
+	}
+	return nil
+}
+
+// enqueueSQLiteSample queues s for writing without blocking; if the writer
+// can't keep up the sample is dropped.
+func enqueueSQLiteSample(s Sample) {
+	if sqliteDB == nil {
+		return
+	}
+	select {
+	case sqliteQueue <- s:
+	default:
+		log.Printf("error: sqlite: queue full, dropping %s sample", s.Source)
+	}
+}
+
+func sqliteWriter(db *sql.DB) {
+	pruneTicker := time.NewTicker(sqlitePruneInterval)
+	pruneSQLite(db)
+	for {
+		select {
+		case s := <-sqliteQueue:
+			_, err := db.Exec(`INSERT OR REPLACE INTO samples
+				(timestamp, source, account, provider, thermostat, temperature, humidity, target_temperature, hvac_state, pressure)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				s.Time.Unix(), s.Source, s.Account, s.Provider, s.Thermostat, s.Temperature, s.Humidity, s.TargetTemperature, s.HvacState, s.Pressure)
+			if err != nil {
+				log.Printf("error: sqlite: %v", err)
+			}
+		case <-pruneTicker.C:
+			pruneSQLite(db)
+		}
+	}
+}
+
+func pruneSQLite(db *sql.DB) {
+	if *sqliteRetention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-*sqliteRetention).Unix()
+	res, err := db.Exec(`DELETE FROM samples WHERE timestamp < ?`, cutoff)
+	if err != nil {
+		log.Printf("error: sqlite: pruning: %v", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 && *doDebug {
+		log.Printf("sqlite: pruned %d samples", n)
+	}
+}
+
+// parseQueryTime accepts RFC 3339 timestamps and Unix seconds.
+func parseQueryTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// httpQueryHandler serves GET /query?from=&to=&source=&account= from the SQLite
+// database. from defaults to 24 hours ago, to to now.
+func httpQueryHandler(w http.ResponseWriter, req *http.Request) {
+	if sqliteDB == nil {
+		http.Error(w, "sqlite logging is not enabled", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	from, err := parseQueryTime(req.FormValue("from"), now.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseQueryTime(req.FormValue("to"), now)
+	if err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	samples, err := querySQLite(from, to, req.FormValue("source"), req.FormValue("account"))
+	if err != nil {
+		log.Printf("error: sqlite: %v", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	b, _ := json.Marshal(samples)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// querySQLite returns the samples between from and to, ordered by time. An
+// empty source or account matches all of them.
+func querySQLite(from, to time.Time, source string, account string) ([]Sample, error) {
+	rows, err := sqliteDB.Query(`SELECT timestamp, source, account, provider, thermostat, temperature, humidity, target_temperature, hvac_state, pressure
+		FROM samples
+		WHERE timestamp >= ? AND timestamp <= ? AND (? = '' OR source = ?) AND (? = '' OR account = ?)
+		ORDER BY timestamp, source, account, thermostat`,
+		from.Unix(), to.Unix(), source, source, account, account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := []Sample{}
+	for rows.Next() {
+		var s Sample
+		var ts int64
+		var temperature, humidity, target, pressure sql.NullFloat64
+		var hvacState sql.NullString
+		if err := rows.Scan(&ts, &s.Source, &s.Account, &s.Provider, &s.Thermostat, &temperature, &humidity, &target, &hvacState, &pressure); err != nil {
+			return nil, err
+		}
+		s.Time = time.Unix(ts, 0)
+		s.Temperature = nullFloat(temperature)
+		s.Humidity = nullFloat(humidity)
+		s.TargetTemperature = nullFloat(target)
+		s.Pressure = nullFloat(pressure)
+		if hvacState.Valid {
+			s.HvacState = &hvacState.String
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+func nullFloat(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
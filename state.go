@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var stateFile = flag.String("state-file", "", "file to persist the last fetched data to, restored at startup")
+
+// stateVersion is bumped whenever persistedState changes incompatibly.
+// Files with a different version are ignored.
+const stateVersion = 1
+
+const stateSaveInterval = time.Minute
+
+type persistedState struct {
+	Version int         `json:"version"`
+	Data    StampedData `json:"data"`
+}
+
+var lastStateSave time.Time
+var stateSaveMutex sync.Mutex
+
+// saveState writes the current data to -state-file, at most once per
+// stateSaveInterval. Errors are logged.
+func saveState() {
+	if *stateFile == "" {
+		return
+	}
+	stateSaveMutex.Lock()
+	defer stateSaveMutex.Unlock()
+	if time.Since(lastStateSave) < stateSaveInterval {
+		return
+	}
+	if err := writeStateFile(*stateFile, currentSnapshot()); err != nil {
+		log.Printf("error: saving state: %v", err)
+		return
+	}
+	lastStateSave = time.Now()
+}
+
+func writeStateFile(path string, data StampedData) error {
+	b, err := json.Marshal(persistedState{Version: stateVersion, Data: data})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+// writeFileAtomic replaces path by writing to a temporary file in the same
+// directory and renaming it.
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readStateFile(path string) (StampedData, error) {
+	var state persistedState
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state.Data, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state.Data, err
+	}
+	if state.Version != stateVersion {
+		return StampedData{}, fmt.Errorf("unsupported state version %d (want %d)", state.Version, stateVersion)
+	}
+	return state.Data, nil
+}
+
+// restoreState loads -state-file and restores the data and gauges from it.
+// The original timestamps are kept, so the restored data still looks as old
+// as it is. A missing or unreadable file is logged and otherwise ignored.
+func restoreState() {
+	if *stateFile == "" {
+		return
+	}
+	data, err := readStateFile(*stateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("warning: ignoring state file %s: %v", *stateFile, err)
+		return
+	}
+	restored := data.Accounts
+	if len(restored) == 0 && !data.ThermostatStamp.IsZero() && len(accounts) > 0 {
+		// Written before multiple accounts were supported.
+		ts := data.ThermostatData
+		ts.Account = accounts[0].name
+		restored = map[string]*AccountData{accounts[0].name: {
+			Provider:    accounts[0].providerName,
+			Stamp:       data.ThermostatStamp,
+			Thermostats: []Reading{ts},
+		}}
+	}
+	var readings []Reading
+	currentDataMutex.Lock()
+	for _, a := range accounts {
+		ad, ok := restored[a.name]
+		if !ok || ad == nil {
+			continue
+		}
+		// Not polled since the restart yet.
+		ad.Up = false
+		ad.LastError = ""
+		accountData[a.name] = ad
+		readings = append(readings, ad.Thermostats...)
+	}
+	currentWeather = data.WeatherData
+	currentWeatherTime = data.WeatherStamp
+	currentDataMutex.Unlock()
+	for _, ts := range readings {
+		setThermostatGauges(ts)
+	}
+	if !data.WeatherStamp.IsZero() {
+		setWeatherGauges(data.WeatherData)
+	}
+	log.Printf("restored state from %s (%d thermostats, weather data from %v)", *stateFile, len(readings), data.WeatherStamp)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Reading is a thermostat reading normalized across providers.
+type Reading struct {
+	Account            string  `json:"account"`
+	Provider           string  `json:"provider"`
+	DeviceID           string  `json:"device_id"`
+	StructureID        string  `json:"structure_id"`
+	CurrentHumidity    float64 `json:"humidity"`
+	CurrentTemperature float64 `json:"ambient_temperature_c"`
+	TargetTemperature  float64 `json:"target_temperature_c"`
+	HvacState          string  `json:"hvac_state"`
+
+	// missing lists the numeric fields absent from the payload, named as
+	// in invalid_readings_total.
+	missing []string
+}
+
+// ThermostatProvider fetches the current state of all thermostats it knows
+// about.
+type ThermostatProvider interface {
+	Fetch(ctx context.Context) ([]Reading, error)
+}
+
+// thermostatProviders maps provider names to constructors. A constructor
+// takes its configuration from an account and returns an error if it is
+// incomplete.
+var thermostatProviders = map[string]func(cfg AccountConfig) (ThermostatProvider, error){}
+
+func registerThermostatProvider(name string, factory func(cfg AccountConfig) (ThermostatProvider, error)) {
+	thermostatProviders[name] = factory
+}
+
+func newThermostatProvider(cfg AccountConfig) (ThermostatProvider, error) {
+	factory, ok := thermostatProviders[cfg.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown thermostat provider %q, valid providers: %s", cfg.Provider, strings.Join(thermostatProviderNames(), ", "))
+	}
+	return factory(cfg)
+}
+
+func thermostatProviderNames() []string {
+	var names []string
+	for name := range thermostatProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fakeProvider returns a fixed reading. It needs no credentials, which makes
+// it handy for trying out dashboards and for tests.
+type fakeProvider struct {
+	readings []Reading
+}
+
+func init() {
+	registerThermostatProvider("fake", func(cfg AccountConfig) (ThermostatProvider, error) {
+		return &fakeProvider{readings: []Reading{{
+			Provider:           "fake",
+			DeviceID:           "fake-thermostat",
+			StructureID:        "fake-structure",
+			CurrentHumidity:    45,
+			CurrentTemperature: 21,
+			TargetTemperature:  21.5,
+			HvacState:          "heating",
+		}}}, nil
+	})
+}
+
+func (p *fakeProvider) Fetch(ctx context.Context) ([]Reading, error) {
+	return p.readings, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollectAccountFakeProvider(t *testing.T) {
+	provider, err := newThermostatProvider(AccountConfig{Name: "fake-account", Provider: "fake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &account{name: "fake-account", providerName: "fake", provider: provider}
+	saved := accounts
+	accounts = []*account{a}
+	t.Cleanup(func() { accounts = saved })
+
+	if err := collectAccount(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	httpDataHandler(rec, httptest.NewRequest("GET", "/data", nil))
+	var data StampedData
+	if err := json.Unmarshal(rec.Body.Bytes(), &data); err != nil {
+		t.Fatalf("/data: %v: %s", err, rec.Body)
+	}
+	account := data.Accounts["fake-account"]
+	if account == nil || !account.Up || len(account.Thermostats) != 1 {
+		t.Fatalf("/data: unexpected account data %+v", account)
+	}
+	ts := account.Thermostats[0]
+	if ts.DeviceID != "fake-thermostat" || ts.Account != "fake-account" || ts.CurrentTemperature != 21 {
+		t.Errorf("/data: unexpected thermostat %+v", ts)
+	}
+	if data.ThermostatData.DeviceID != "fake-thermostat" || data.ThermostatStamp.IsZero() {
+		t.Errorf("/data: legacy fields not filled: %+v at %v", data.ThermostatData, data.ThermostatStamp)
+	}
+
+	labels := []string{"fake-account", "fake", "fake-thermostat"}
+	for _, g := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"env_temperature", testutil.ToFloat64(promTemperature.WithLabelValues(labels...)), 21},
+		{"env_humidity", testutil.ToFloat64(promHumidity.WithLabelValues(labels...)), 45},
+		{"target_temperature", testutil.ToFloat64(promTargetTemperature.WithLabelValues(labels...)), 21.5},
+		{"is_heating", testutil.ToFloat64(promIsHeating.WithLabelValues(labels...)), 1},
+		{"thermostat_up", testutil.ToFloat64(promThermostatUp.WithLabelValues("fake-account")), 1},
+	} {
+		if g.got != g.want {
+			t.Errorf("%s = %v, want %v", g.name, g.got, g.want)
+		}
+	}
+}
+
+func TestCollectAccountRemovedThermostatHistory(t *testing.T) {
+	initHistory()
+	p := &fakeProvider{readings: []Reading{
+		{Provider: "fake", DeviceID: "t1", CurrentHumidity: 40, CurrentTemperature: 20, TargetTemperature: 21},
+		{Provider: "fake", DeviceID: "t2", CurrentHumidity: 50, CurrentTemperature: 19, TargetTemperature: 21},
+	}}
+	a := &account{name: "removed-history", providerName: "fake", provider: p}
+	if err := collectAccount(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	p.readings = p.readings[:1]
+	if err := collectAccount(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+
+	historyMutex.Lock()
+	for _, tier := range historyTiers {
+		for _, pt := range tier.query(time.Time{}, time.Now().Add(time.Hour), sourceThermostat, a.name) {
+			if pt.Thermostat == "t2" {
+				t.Errorf("%s: history of removed thermostat kept: %+v", tier.name, pt)
+			}
+		}
+	}
+	historyMutex.Unlock()
+	if n := historySampleCount(sourceThermostat, a.name); n != 2 {
+		t.Errorf("%d samples left, want the 2 of t1", n)
+	}
+}
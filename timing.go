@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var detailedTimingMetrics = flag.Bool("detailed-timing-metrics", false, "export per-phase timings (DNS, connect, TLS, first byte) of upstream requests")
+
+var (
+	promUpstreamDNS = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "upstream_dns_lookup_seconds",
+		Help: "Time spent resolving the upstream host name.",
+	}, []string{"target"})
+	promUpstreamConnect = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "upstream_connect_seconds",
+		Help: "Time spent establishing the TCP connection to the upstream.",
+	}, []string{"target"})
+	promUpstreamTLS = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "upstream_tls_handshake_seconds",
+		Help: "Time spent in the TLS handshake with the upstream.",
+	}, []string{"target"})
+	promUpstreamFirstByte = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "upstream_first_byte_seconds",
+		Help: "Time from the request being written until the first response byte arrived.",
+	}, []string{"target"})
+	promUpstreamConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_connections_total",
+		Help: "Connections used for upstream requests, by whether they were reused.",
+	}, []string{"target", "reused"})
+)
+
+// registerTimingMetrics registers the per-phase metrics. They are only
+// registered when -detailed-timing-metrics is on, so call it after
+// flag.Parse.
+func registerTimingMetrics() {
+	if !*detailedTimingMetrics {
+		return
+	}
+	prometheus.MustRegister(promUpstreamDNS)
+	prometheus.MustRegister(promUpstreamConnect)
+	prometheus.MustRegister(promUpstreamTLS)
+	prometheus.MustRegister(promUpstreamFirstByte)
+	prometheus.MustRegister(promUpstreamConnections)
+}
+
+// traceRequest attaches httptrace hooks to req which record the phase
+// timings under the given target label. Without -detailed-timing-metrics
+// req is returned unchanged.
+func traceRequest(req *http.Request, target string) *http.Request {
+	if !*detailedTimingMetrics {
+		return req
+	}
+
+	// Hooks for parallel dial attempts may run concurrently.
+	var mu sync.Mutex
+	var dnsStart, tlsStart, wroteRequest time.Time
+	connectStart := map[string]time.Time{}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			promUpstreamDNS.WithLabelValues(target).Observe(time.Since(dnsStart).Seconds())
+			mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart[network+addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			promUpstreamConnect.WithLabelValues(target).Observe(time.Since(connectStart[network+addr]).Seconds())
+			mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			promUpstreamTLS.WithLabelValues(target).Observe(time.Since(tlsStart).Seconds())
+			mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			promUpstreamConnections.WithLabelValues(target, strconv.FormatBool(info.Reused)).Inc()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			wroteRequest = time.Now()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			promUpstreamFirstByte.WithLabelValues(target).Observe(time.Since(wroteRequest).Seconds())
+			mu.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
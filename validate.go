@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var validTemperatureMin = flag.Float64("valid-temperature-min", -60, "lowest plausible temperature (°C), lower readings are rejected")
+var validTemperatureMax = flag.Float64("valid-temperature-max", 60, "highest plausible temperature (°C), higher readings are rejected")
+var validHumidityMin = flag.Float64("valid-humidity-min", 0, "lowest plausible relative humidity (%)")
+var validHumidityMax = flag.Float64("valid-humidity-max", 100, "highest plausible relative humidity (%)")
+var validPressureMin = flag.Float64("valid-pressure-min", 800, "lowest plausible pressure (hPa) at sea level; scaled to -station-elevation-m if set")
+var validPressureMax = flag.Float64("valid-pressure-max", 1100, "highest plausible pressure (hPa)")
+
+var promInvalidReadings = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "invalid_readings_total",
+	Help: "Number of implausible readings that were rejected, by field.",
+}, []string{"field"})
+
+func init() {
+	prometheus.MustRegister(promInvalidReadings)
+}
+
+// checkRange returns value and true if it lies within [min, max] and was
+// present in the payload, and previous and false otherwise. A rejected value
+// is counted and logged.
+func checkRange(field string, value, previous, min, max float64, missing []string) (float64, bool) {
+	if isMissing(field, missing) {
+		log.Printf("warning: rejecting missing %s, keeping previous value %v", field, previous)
+		promInvalidReadings.WithLabelValues(field).Inc()
+		return previous, false
+	}
+	if value >= min && value <= max {
+		return value, true
+	}
+	rejectReading(field, value, previous)
+	return previous, false
+}
+
+// payloadValue returns *p, or 0 after adding field to missing if the
+// payload did not have it.
+func payloadValue(field string, p *float64, missing *[]string) float64 {
+	if p == nil {
+		*missing = append(*missing, field)
+		return 0
+	}
+	return *p
+}
+
+func isMissing(field string, missing []string) bool {
+	for _, f := range missing {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func rejectReading(field string, value, previous float64) {
+	log.Printf("warning: rejecting implausible %s %v, keeping previous value %v", field, value, previous)
+	promInvalidReadings.WithLabelValues(field).Inc()
+}
+
+// emptyThermostatData reports whether every numeric field of the raw
+// reading is zero or missing, which is what the API sends when it is only
+// partially populated.
+func emptyThermostatData(ts Reading) bool {
+	return ts.CurrentTemperature == 0 && ts.CurrentHumidity == 0 && ts.TargetTemperature == 0
+}
+
+// rejectEmptyThermostatData rejects all numeric fields of an empty reading,
+// keeping the values from the previous poll.
+func rejectEmptyThermostatData(ts Reading, previous Reading) Reading {
+	rejectReading("humidity", ts.CurrentHumidity, previous.CurrentHumidity)
+	rejectReading("temperature", ts.CurrentTemperature, previous.CurrentTemperature)
+	rejectReading("target_temperature", ts.TargetTemperature, previous.TargetTemperature)
+	ts.CurrentHumidity = previous.CurrentHumidity
+	ts.CurrentTemperature = previous.CurrentTemperature
+	ts.TargetTemperature = previous.TargetTemperature
+	ts.missing = nil
+	return ts
+}
+
+// validateThermostatData replaces implausible fields in ts with the values
+// from the previous poll, and reports whether all fields were accepted.
+func validateThermostatData(ts Reading, previous Reading) (Reading, bool) {
+	var humidityOK, temperatureOK, targetOK bool
+	ts.CurrentHumidity, humidityOK = checkRange("humidity", ts.CurrentHumidity, previous.CurrentHumidity, *validHumidityMin, *validHumidityMax, ts.missing)
+	ts.CurrentTemperature, temperatureOK = checkRange("temperature", ts.CurrentTemperature, previous.CurrentTemperature, *validTemperatureMin, *validTemperatureMax, ts.missing)
+	ts.TargetTemperature, targetOK = checkRange("target_temperature", ts.TargetTemperature, previous.TargetTemperature, *validTemperatureMin, *validTemperatureMax, ts.missing)
+	ts.missing = nil
+	return ts, humidityOK && temperatureOK && targetOK
+}
+
+// emptyWeather reports whether every numeric field of the raw observation
+// is zero or missing, see emptyThermostatData.
+func emptyWeather(w Observation) bool {
+	return w.Temperature == 0 && w.Humidity == 0 && w.Pressure == 0
+}
+
+// rejectEmptyWeather rejects an empty observation as a whole, keeping the
+// previous one.
+func rejectEmptyWeather(w Observation, previous Observation) Observation {
+	rejectReading("outside_temperature", w.Temperature, previous.Temperature)
+	rejectReading("outside_humidity", w.Humidity, previous.Humidity)
+	rejectReading("outside_pressure", w.Pressure, previous.Pressure)
+	return previous
+}
+
+// validateWeather replaces implausible fields in w with the values from the
+// previous poll, and reports whether all fields were accepted. w.missing is
+// kept, so later code knows which values were not observed.
+func validateWeather(w Observation, previous Observation) (Observation, bool) {
+	var temperatureOK, humidityOK, pressureOK bool
+	w.Temperature, temperatureOK = checkRange("outside_temperature", w.Temperature, previous.Temperature, *validTemperatureMin, *validTemperatureMax, w.missing)
+	w.Humidity, humidityOK = checkRange("outside_humidity", w.Humidity, previous.Humidity, *validHumidityMin, *validHumidityMax, w.missing)
+	// Station pressure at altitude is well below the sea-level range, so
+	// lower the minimum by the standard atmosphere's drop at the elevation.
+	pressureMin := *validPressureMin
+	if seaLevelCorrection {
+		pressureMin *= math.Pow(1-0.0065*(*stationElevation)/288.15, 5.257)
+	}
+	w.Pressure, pressureOK = checkRange("outside_pressure", w.Pressure, previous.Pressure, pressureMin, *validPressureMax, w.missing)
+	return w, temperatureOK && humidityOK && pressureOK
+}
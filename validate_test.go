@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func invalidCount(field string) float64 {
+	return testutil.ToFloat64(promInvalidReadings.WithLabelValues(field))
+}
+
+// countInvalid returns how much invalid_readings_total grew per field while
+// f ran.
+func countInvalid(fields []string, f func()) map[string]float64 {
+	before := map[string]float64{}
+	for _, field := range fields {
+		before[field] = invalidCount(field)
+	}
+	f()
+	delta := map[string]float64{}
+	for _, field := range fields {
+		if d := invalidCount(field) - before[field]; d != 0 {
+			delta[field] = d
+		}
+	}
+	return delta
+}
+
+var thermostatFields = []string{"humidity", "temperature", "target_temperature"}
+var weatherFields = []string{"outside_temperature", "outside_humidity", "outside_pressure"}
+
+func equalCounts(a, b map[string]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestValidateThermostatData(t *testing.T) {
+	previous := Reading{DeviceID: "t1", CurrentHumidity: 40, CurrentTemperature: 20, TargetTemperature: 21}
+	tests := []struct {
+		name     string
+		in       Reading
+		want     Reading
+		rejected map[string]float64
+	}{
+		{
+			name: "valid",
+			in:   Reading{DeviceID: "t1", CurrentHumidity: 45, CurrentTemperature: 22, TargetTemperature: 20},
+			want: Reading{DeviceID: "t1", CurrentHumidity: 45, CurrentTemperature: 22, TargetTemperature: 20},
+		},
+		{
+			name:     "humidity out of range",
+			in:       Reading{DeviceID: "t1", CurrentHumidity: 140, CurrentTemperature: 22, TargetTemperature: 20},
+			want:     Reading{DeviceID: "t1", CurrentHumidity: 40, CurrentTemperature: 22, TargetTemperature: 20},
+			rejected: map[string]float64{"humidity": 1},
+		},
+		{
+			name:     "temperatures out of range",
+			in:       Reading{DeviceID: "t1", CurrentHumidity: 45, CurrentTemperature: 85, TargetTemperature: -70},
+			want:     Reading{DeviceID: "t1", CurrentHumidity: 45, CurrentTemperature: 20, TargetTemperature: 21},
+			rejected: map[string]float64{"temperature": 1, "target_temperature": 1},
+		},
+		{
+			name:     "humidity missing",
+			in:       Reading{DeviceID: "t1", CurrentTemperature: 22, TargetTemperature: 20, missing: []string{"humidity"}},
+			want:     Reading{DeviceID: "t1", CurrentHumidity: 40, CurrentTemperature: 22, TargetTemperature: 20},
+			rejected: map[string]float64{"humidity": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Reading
+			rejected := countInvalid(thermostatFields, func() {
+				got, _ = validateThermostatData(tt.in, previous)
+			})
+			if got.CurrentHumidity != tt.want.CurrentHumidity || got.CurrentTemperature != tt.want.CurrentTemperature ||
+				got.TargetTemperature != tt.want.TargetTemperature || got.DeviceID != tt.want.DeviceID {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if !equalCounts(rejected, tt.rejected) {
+				t.Errorf("rejected %v, want %v", rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestValidateWeather(t *testing.T) {
+	previous := Observation{Temperature: 5, Humidity: 80, Pressure: 1010}
+	tests := []struct {
+		name     string
+		in       Observation
+		want     Observation
+		rejected map[string]float64
+	}{
+		{
+			name: "valid",
+			in:   Observation{Temperature: -3, Humidity: 90, Pressure: 1020},
+			want: Observation{Temperature: -3, Humidity: 90, Pressure: 1020},
+		},
+		{
+			name:     "pressure out of range",
+			in:       Observation{Temperature: -3, Humidity: 90, Pressure: 2000},
+			want:     Observation{Temperature: -3, Humidity: 90, Pressure: 1010},
+			rejected: map[string]float64{"outside_pressure": 1},
+		},
+		{
+			name:     "temperature and humidity out of range",
+			in:       Observation{Temperature: 99, Humidity: -1, Pressure: 1020},
+			want:     Observation{Temperature: 5, Humidity: 80, Pressure: 1020},
+			rejected: map[string]float64{"outside_temperature": 1, "outside_humidity": 1},
+		},
+		{
+			name:     "humidity missing",
+			in:       Observation{Temperature: -3, Pressure: 1020, missing: []string{"outside_humidity"}},
+			want:     Observation{Temperature: -3, Humidity: 80, Pressure: 1020},
+			rejected: map[string]float64{"outside_humidity": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Observation
+			rejected := countInvalid(weatherFields, func() {
+				got, _ = validateWeather(tt.in, previous)
+			})
+			if got.Temperature != tt.want.Temperature || got.Humidity != tt.want.Humidity || got.Pressure != tt.want.Pressure {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if !equalCounts(rejected, tt.rejected) {
+				t.Errorf("rejected %v, want %v", rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestEmptyThermostatData(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Reading
+		want bool
+	}{
+		{"all zero", Reading{DeviceID: "t1", HvacState: "off"}, true},
+		{"all missing", Reading{DeviceID: "t1", missing: []string{"humidity", "temperature", "target_temperature"}}, true},
+		{"temperature set", Reading{DeviceID: "t1", CurrentTemperature: 20}, false},
+		{"only target set", Reading{DeviceID: "t1", TargetTemperature: 20}, false},
+	}
+	for _, tt := range tests {
+		if got := emptyThermostatData(tt.in); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRejectEmptyThermostatData(t *testing.T) {
+	previous := Reading{DeviceID: "t1", CurrentHumidity: 40, CurrentTemperature: 20, TargetTemperature: 21}
+	var got Reading
+	rejected := countInvalid(thermostatFields, func() {
+		got = rejectEmptyThermostatData(Reading{DeviceID: "t1", HvacState: "heating"}, previous)
+	})
+	want := Reading{DeviceID: "t1", HvacState: "heating", CurrentHumidity: 40, CurrentTemperature: 20, TargetTemperature: 21}
+	if got.CurrentHumidity != want.CurrentHumidity || got.CurrentTemperature != want.CurrentTemperature ||
+		got.TargetTemperature != want.TargetTemperature || got.HvacState != want.HvacState {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if want := map[string]float64{"humidity": 1, "temperature": 1, "target_temperature": 1}; !equalCounts(rejected, want) {
+		t.Errorf("rejected %v, want %v", rejected, want)
+	}
+}
+
+func TestRejectEmptyWeather(t *testing.T) {
+	previous := Observation{Temperature: 5, Humidity: 80, Pressure: 1010}
+	if !emptyWeather(Observation{}) {
+		t.Error("zero observation not empty")
+	}
+	var got Observation
+	rejected := countInvalid(weatherFields, func() {
+		got = rejectEmptyWeather(Observation{}, previous)
+	})
+	if got.Temperature != 5 || got.Humidity != 80 || got.Pressure != 1010 {
+		t.Errorf("got %+v, want %+v", got, previous)
+	}
+	if want := map[string]float64{"outside_temperature": 1, "outside_humidity": 1, "outside_pressure": 1}; !equalCounts(rejected, want) {
+		t.Errorf("rejected %v, want %v", rejected, want)
+	}
+}
+
+func historySampleCount(source, account string) int {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	n := 0
+	for _, p := range historyTiers[0].query(time.Time{}, time.Now().Add(time.Hour), source, account) {
+		n += p.Count
+	}
+	return n
+}
+
+func TestCollectAccountEmptyPayloadIsNotFresh(t *testing.T) {
+	initHistory()
+	p := &fakeProvider{readings: []Reading{{Provider: "fake", DeviceID: "t1", CurrentHumidity: 40, CurrentTemperature: 20, TargetTemperature: 21}}}
+	a := &account{name: "empty-payload", providerName: "fake", provider: p}
+	if err := collectAccount(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	stamp := currentSnapshot().Accounts[a.name].Stamp
+
+	p.readings = []Reading{{Provider: "fake", DeviceID: "t1"}}
+	if err := collectAccount(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	data := currentSnapshot().Accounts[a.name]
+	if !data.Stamp.Equal(stamp) {
+		t.Errorf("stamp advanced from %v to %v on an empty payload", stamp, data.Stamp)
+	}
+	if ts := data.Thermostats[0]; ts.CurrentTemperature != 20 || ts.CurrentHumidity != 40 {
+		t.Errorf("previous values not kept: %+v", ts)
+	}
+	if n := historySampleCount(sourceThermostat, a.name); n != 1 {
+		t.Errorf("%d samples recorded, want 1", n)
+	}
+}
+
+func TestCollectAccountFirstPollRejected(t *testing.T) {
+	p := &fakeProvider{readings: []Reading{
+		{Provider: "fake", DeviceID: "t1", CurrentTemperature: 20, TargetTemperature: 21, missing: []string{"humidity"}},
+		{Provider: "fake", DeviceID: "t2", CurrentHumidity: 40, CurrentTemperature: 99, TargetTemperature: 21},
+		{Provider: "fake", DeviceID: "t3"},
+	}}
+	a := &account{name: "first-poll", providerName: "fake", provider: p}
+	if err := collectAccount(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	if data := currentSnapshot().Accounts[a.name]; len(data.Thermostats) != 0 || !data.Stamp.IsZero() {
+		t.Errorf("rejected first readings stored: %+v", data)
+	}
+	for _, id := range []string{"t1", "t2", "t3"} {
+		if promTemperature.DeleteLabelValues(a.name, "fake", id) || promHumidity.DeleteLabelValues(a.name, "fake", id) {
+			t.Errorf("%s: gauges set without a valid reading", id)
+		}
+	}
+
+	p.readings[0].CurrentHumidity = 45
+	p.readings[0].missing = nil
+	if err := collectAccount(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	data := currentSnapshot().Accounts[a.name]
+	if len(data.Thermostats) != 1 || data.Thermostats[0].DeviceID != "t1" {
+		t.Fatalf("unexpected thermostats %+v", data.Thermostats)
+	}
+	if got := testutil.ToFloat64(promHumidity.WithLabelValues(a.name, "fake", "t1")); got != 45 {
+		t.Errorf("env_humidity = %v, want 45", got)
+	}
+}
+
+type staticWeather struct {
+	obs Observation
+}
+
+func (w *staticWeather) Fetch(ctx context.Context) (Observation, error) {
+	return w.obs, nil
+}
+
+func TestCollectWeatherEmptyPayloadIsNotFresh(t *testing.T) {
+	initHistory()
+	w := &staticWeather{obs: Observation{Temperature: 5, Humidity: 80, Pressure: 1010}}
+	if err := collectWeather(context.Background(), w); err != nil {
+		t.Fatal(err)
+	}
+	stamp := currentSnapshot().WeatherStamp
+
+	w.obs = Observation{missing: []string{"outside_temperature", "outside_humidity", "outside_pressure"}}
+	if err := collectWeather(context.Background(), w); err != nil {
+		t.Fatal(err)
+	}
+	snap := currentSnapshot()
+	if !snap.WeatherStamp.Equal(stamp) {
+		t.Errorf("stamp advanced from %v to %v on an empty payload", stamp, snap.WeatherStamp)
+	}
+	if snap.WeatherData.Temperature != 5 {
+		t.Errorf("previous observation not kept: %+v", snap.WeatherData)
+	}
+	if n := historySampleCount(sourceWeather, ""); n != 1 {
+		t.Errorf("%d samples recorded, want 1", n)
+	}
+}
+
+func TestPartialNestPayload(t *testing.T) {
+	var data nestThermostat
+	if err := json.Unmarshal([]byte(`{"ambient_temperature_c": 20.5, "target_temperature_c": 21}`), &data); err != nil {
+		t.Fatal(err)
+	}
+	previous := Reading{DeviceID: "t1", CurrentHumidity: 40}
+	var got Reading
+	rejected := countInvalid(thermostatFields, func() {
+		got, _ = validateThermostatData(nestReading("t1", data), previous)
+	})
+	if got.CurrentHumidity != 40 || got.CurrentTemperature != 20.5 {
+		t.Errorf("got %+v, want humidity kept at 40", got)
+	}
+	if want := map[string]float64{"humidity": 1}; !equalCounts(rejected, want) {
+		t.Errorf("rejected %v, want %v", rejected, want)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Observation is an outdoor weather observation normalized across providers.
+// Wind and cloud data are not offered by every provider and are nil when
+// missing.
+type Observation struct {
+	Temperature   float64   `json:"temp"`
+	Pressure      float64   `json:"pressure"`
+	Humidity      float64   `json:"humidity"`
+	WindSpeed     *float64  `json:"wind_speed,omitempty"`
+	WindDirection *float64  `json:"wind_deg,omitempty"`
+	Clouds        *float64  `json:"clouds,omitempty"`
+	ObservedAt    time.Time `json:"observed_at"`
+
+	// missing lists the numeric fields absent from the payload, named as
+	// in invalid_readings_total.
+	missing []string
+}
+
+// WeatherProvider fetches the current outdoor weather.
+type WeatherProvider interface {
+	Fetch(ctx context.Context) (Observation, error)
+}
+
+// weatherProviders maps -weather-provider names to constructors. A
+// constructor validates its flags and returns an error if they are
+// incomplete.
+var weatherProviders = map[string]func() (WeatherProvider, error){}
+
+func registerWeatherProvider(name string, factory func() (WeatherProvider, error)) {
+	weatherProviders[name] = factory
+}
+
+func newWeatherProvider(name string) (WeatherProvider, error) {
+	factory, ok := weatherProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown weather provider %q, valid providers: %s", name, strings.Join(weatherProviderNames(), ", "))
+	}
+	return factory()
+}
+
+func weatherProviderNames() []string {
+	var names []string
+	for name := range weatherProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
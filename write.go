@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var enableWriteAPI = flag.Bool("enable-write-api", false, "enable the POST endpoints that change thermostat settings")
+var writeAPIToken = flag.String("write-api-token", "", "bearer token the write API requires (mandatory with -enable-write-api)")
+var writeTargetMin = flag.Float64("write-target-min", 9, "lowest target temperature (°C) the write API accepts")
+var writeTargetMax = flag.Float64("write-target-max", 32, "highest target temperature (°C) the write API accepts")
+var writeMinInterval = flag.Duration("write-min-interval", 10*time.Second, "minimum time between two requests to the same write endpoint")
+
+var (
+	promWriteRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "write_api_requests_total",
+		Help: "Requests to the write API, by endpoint and outcome.",
+	}, []string{"endpoint", "outcome"})
+	promIsAway = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "is_away",
+		Help: "Flag (0 or 1) indicating if the structure is set to away, as of the last /away request.",
+	}, []string{"account", "provider", "structure"})
+)
+
+func init() {
+	prometheus.MustRegister(promWriteRequests)
+	collectGroup("thermostat.away", promIsAway)
+}
+
+// errWriteRejected is wrapped by providers when they refuse a write before
+// talking to the API, e.g. because the thermostat is locked.
+var errWriteRejected = errors.New("write rejected")
+
+// AwaySetter is implemented by thermostat providers that can switch a
+// structure between home and away. SetAway returns the upstream HTTP status
+// and body.
+type AwaySetter interface {
+	SetAway(ctx context.Context, structureID string, away bool) (int, []byte, error)
+	Away(ctx context.Context, structureID string) (bool, error)
+}
+
+// TargetSetter is implemented by thermostat providers that can change the
+// target temperature. It returns the upstream HTTP status and body. An
+// empty thermostatID selects the only thermostat, if there is just one.
+type TargetSetter interface {
+	SetTarget(ctx context.Context, thermostatID string, celsius float64) (int, []byte, error)
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// requireWriteAuth only lets POST requests with the configured bearer token
+// through to h, and no more than one per -write-min-interval.
+func requireWriteAuth(h http.HandlerFunc) http.HandlerFunc {
+	var mu sync.Mutex
+	var last time.Time
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		auth := req.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(*writeAPIToken)) != 1 {
+			log.Printf("write: unauthorized %s %s from %s", req.Method, req.URL.Path, remoteIP(req))
+			promWriteRequests.WithLabelValues(req.URL.Path, "unauthorized").Inc()
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		if time.Since(last) < *writeMinInterval {
+			mu.Unlock()
+			promWriteRequests.WithLabelValues(req.URL.Path, "rate_limited").Inc()
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		last = time.Now()
+		mu.Unlock()
+		h(w, req)
+	}
+}
+
+// httpTargetHandler serves POST /target with a body like
+// {"temperature_c": 21.5}, passing the API's response through. "account"
+// and "thermostat" select the device if more than one is configured. After
+// a successful write the account is fetched again.
+func httpTargetHandler(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Account      string   `json:"account"`
+		Thermostat   string   `json:"thermostat"`
+		TemperatureC *float64 `json:"temperature_c"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.TemperatureC == nil {
+		promWriteRequests.WithLabelValues("/target", "invalid").Inc()
+		http.Error(w, `expected {"temperature_c": <number>}`, http.StatusBadRequest)
+		return
+	}
+	celsius := *body.TemperatureC
+	if celsius < *writeTargetMin || celsius > *writeTargetMax {
+		promWriteRequests.WithLabelValues("/target", "invalid").Inc()
+		http.Error(w, "temperature_c outside the allowed range", http.StatusBadRequest)
+		return
+	}
+	a, err := findAccount(body.Account)
+	if err != nil {
+		promWriteRequests.WithLabelValues("/target", "invalid").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setter, ok := a.provider.(TargetSetter)
+	if !ok {
+		promWriteRequests.WithLabelValues("/target", "unsupported").Inc()
+		http.Error(w, "thermostat provider does not support setting the target temperature", http.StatusNotImplemented)
+		return
+	}
+
+	status, respBody, err := setter.SetTarget(req.Context(), body.Thermostat, celsius)
+	if err != nil {
+		log.Printf("write: %s set target temperature of %s/%s to %v: %v", remoteIP(req), a.name, body.Thermostat, celsius, err)
+		if errors.Is(err, errWriteRejected) {
+			promWriteRequests.WithLabelValues("/target", "rejected").Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			promWriteRequests.WithLabelValues("/target", "error").Inc()
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	log.Printf("write: %s set target temperature of %s/%s to %v: status %d", remoteIP(req), a.name, body.Thermostat, celsius, status)
+	promWriteRequests.WithLabelValues("/target", writeOutcome(status)).Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(respBody)
+	if status >= 200 && status < 300 {
+		a.requestPoll()
+	}
+}
+
+func writeOutcome(status int) string {
+	if status >= 200 && status < 300 {
+		return "ok"
+	}
+	return "refused"
+}
+
+// accountStructureID returns the structure of the first thermostat of a
+// as of the last poll, or "" if there is none yet.
+func accountStructureID(a *account) string {
+	currentDataMutex.Lock()
+	defer currentDataMutex.Unlock()
+	if data, ok := accountData[a.name]; ok {
+		for _, ts := range data.Thermostats {
+			if ts.StructureID != "" {
+				return ts.StructureID
+			}
+		}
+	}
+	return ""
+}
+
+// refreshAway updates the is_away gauge of a.
+func refreshAway(ctx context.Context, a *account, setter AwaySetter, structureID string) {
+	away, err := setter.Away(ctx, structureID)
+	if err != nil {
+		log.Printf("error: account %s: fetching away state: %v", a.name, err)
+		return
+	}
+	var isAway float64
+	if away {
+		isAway = 1
+	}
+	promIsAway.WithLabelValues(a.name, a.providerName, structureID).Set(isAway)
+}
+
+// httpAwayHandler serves POST /away with a body like {"away": true}, and
+// "account" if more than one is configured. The structure is the one of
+// the account's thermostats as of the last poll. If the API refuses the
+// change (400 or 403, e.g. because auto-away is in control), it answers 409
+// with the API's message; other upstream errors become 502. Afterwards the
+// away state is fetched again.
+func httpAwayHandler(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Account string `json:"account"`
+		Away    *bool  `json:"away"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Away == nil {
+		promWriteRequests.WithLabelValues("/away", "invalid").Inc()
+		http.Error(w, `expected {"away": true|false}`, http.StatusBadRequest)
+		return
+	}
+	a, err := findAccount(body.Account)
+	if err != nil {
+		promWriteRequests.WithLabelValues("/away", "invalid").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	setter, ok := a.provider.(AwaySetter)
+	if !ok {
+		promWriteRequests.WithLabelValues("/away", "unsupported").Inc()
+		http.Error(w, "thermostat provider does not support setting away", http.StatusNotImplemented)
+		return
+	}
+
+	structureID := accountStructureID(a)
+	if structureID == "" {
+		promWriteRequests.WithLabelValues("/away", "error").Inc()
+		http.Error(w, "structure not known yet, retry after the next poll", http.StatusServiceUnavailable)
+		return
+	}
+
+	status, respBody, err := setter.SetAway(req.Context(), structureID, *body.Away)
+	if err != nil {
+		log.Printf("write: %s set away of %s to %v: %v", remoteIP(req), a.name, *body.Away, err)
+		promWriteRequests.WithLabelValues("/away", "error").Inc()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Printf("write: %s set away of %s to %v: status %d", remoteIP(req), a.name, *body.Away, status)
+	respStatus := awayResponseStatus(status)
+	outcome := writeOutcome(status)
+	if respStatus == http.StatusBadGateway {
+		outcome = "error"
+	}
+	promWriteRequests.WithLabelValues("/away", outcome).Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(respStatus)
+	w.Write(respBody)
+	go refreshAway(context.Background(), a, setter, structureID)
+}
+
+// awayResponseStatus maps the upstream status of an away change to ours:
+// refusals become 409, other failures 502.
+func awayResponseStatus(status int) int {
+	switch {
+	case status >= 200 && status < 300:
+		return status
+	case status == http.StatusBadRequest, status == http.StatusForbidden:
+		return http.StatusConflict
+	}
+	return http.StatusBadGateway
+}
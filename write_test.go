@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeAwaySetter struct {
+	fakeProvider
+	status int
+
+	mu         sync.Mutex
+	structures []string
+}
+
+func (s *fakeAwaySetter) SetAway(ctx context.Context, structureID string, away bool) (int, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.structures = append(s.structures, structureID)
+	return s.status, []byte(`{}`), nil
+}
+
+func (s *fakeAwaySetter) Away(ctx context.Context, structureID string) (bool, error) {
+	return true, nil
+}
+
+func TestHTTPAwayHandler(t *testing.T) {
+	tests := []struct {
+		upstream, want int
+	}{
+		{http.StatusOK, http.StatusOK},
+		{http.StatusBadRequest, http.StatusConflict},
+		{http.StatusForbidden, http.StatusConflict},
+		{http.StatusUnauthorized, http.StatusBadGateway},
+		{http.StatusTooManyRequests, http.StatusBadGateway},
+		{http.StatusInternalServerError, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		setter := &fakeAwaySetter{status: tt.upstream}
+		a := &account{name: "away-test", providerName: "fake", provider: setter}
+		saved := accounts
+		accounts = []*account{a}
+		currentDataMutex.Lock()
+		accountData[a.name] = &AccountData{Thermostats: []Reading{{DeviceID: "t1", StructureID: "s1"}}}
+		currentDataMutex.Unlock()
+
+		rec := httptest.NewRecorder()
+		httpAwayHandler(rec, httptest.NewRequest("POST", "/away", strings.NewReader(`{"away": true}`)))
+		accounts = saved
+		if rec.Code != tt.want {
+			t.Errorf("upstream %d: got %d, want %d", tt.upstream, rec.Code, tt.want)
+		}
+		setter.mu.Lock()
+		if len(setter.structures) != 1 || setter.structures[0] != "s1" {
+			t.Errorf("upstream %d: SetAway called for %v, want [s1]", tt.upstream, setter.structures)
+		}
+		setter.mu.Unlock()
+	}
+}